@@ -0,0 +1,304 @@
+package ntraversal
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// coordinationTTL is how long a coordination is considered in flight
+	// when not both sides report a result.
+	coordinationTTL = 2 * time.Minute
+
+	// natTypeTTL is how long the NAT type reported by a peer is kept, as
+	// peers move between networks.
+	natTypeTTL = time.Hour
+
+	// recentPunchesSize is the number of punch reports kept for
+	// inspection.
+	recentPunchesSize = 100
+)
+
+// ClientInfo describes a peer with an open traversal stream to us.
+type ClientInfo struct {
+	ID peer.ID
+	// Addrs are the addresses the peer is connected to us from.
+	Addrs []ma.Multiaddr
+	// NATType is the NAT type the peer reported in its last punch result.
+	NATType string
+}
+
+// Coordination is a punch a service node is coordinating.
+type Coordination struct {
+	Initiator peer.ID
+	Target    peer.ID
+	Started   time.Time
+	// Reported counts the sides which reported a result.
+	Reported int
+
+	initiatorReported, targetReported bool
+}
+
+// PunchReport is a punch result reported to a service node.
+type PunchReport struct {
+	Time      time.Time
+	From      peer.ID
+	Peer      peer.ID
+	Success   bool
+	Addr      ma.Multiaddr
+	Transport string
+	Strategy  string
+	Elapsed   time.Duration
+	Attempts  int
+	Error     string
+	NATType   string
+}
+
+type coordKey struct {
+	initiator, target peer.ID
+}
+
+type natTypeReport struct {
+	natType  NATType
+	reported time.Time
+}
+
+// registry keeps what a service node knows about its clients for
+// inspection by operators.
+type registry struct {
+	mux       sync.Mutex
+	natTypes  map[peer.ID]natTypeReport
+	coords    map[coordKey]*Coordination
+	lastPrune time.Time
+	punches   []PunchReport
+	nextPunch int
+	banned    map[peer.ID]struct{}
+}
+
+func newRegistry() *registry {
+	return &registry{
+		natTypes: make(map[peer.ID]natTypeReport),
+		coords:   make(map[coordKey]*Coordination),
+		banned:   make(map[peer.ID]struct{}),
+	}
+}
+
+// prune drops expired coordinations and NAT types. It runs at most once
+// per coordinationTTL, so callers can call it on every change. r.mux must
+// be held.
+func (r *registry) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < coordinationTTL {
+		return
+	}
+	r.lastPrune = now
+
+	for k, c := range r.coords {
+		if now.Sub(c.Started) > coordinationTTL {
+			delete(r.coords, k)
+		}
+	}
+	for p, t := range r.natTypes {
+		if now.Sub(t.reported) > natTypeTTL {
+			delete(r.natTypes, p)
+		}
+	}
+}
+
+func (r *registry) startCoordination(initiator, target peer.ID) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.prune(time.Now())
+
+	r.coords[coordKey{initiator, target}] = &Coordination{
+		Initiator: initiator,
+		Target:    target,
+		Started:   time.Now(),
+	}
+}
+
+// addReport records a punch result of a coordination in flight. It
+// returns false and records nothing if rep matches no coordination or its
+// sender already reported.
+func (r *registry) addReport(rep PunchReport, natType NATType) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.prune(time.Now())
+
+	var (
+		key   coordKey
+		coord *Coordination
+	)
+	for _, k := range []coordKey{{rep.From, rep.Peer}, {rep.Peer, rep.From}} {
+		if c, ok := r.coords[k]; ok && time.Since(c.Started) <= coordinationTTL {
+			key, coord = k, c
+			break
+		}
+	}
+	if coord == nil {
+		return false
+	}
+	side := &coord.targetReported
+	if rep.From == coord.Initiator {
+		side = &coord.initiatorReported
+	}
+	if *side {
+		return false
+	}
+	*side = true
+	coord.Reported++
+	if coord.Reported >= 2 {
+		delete(r.coords, key)
+	}
+
+	r.natTypes[rep.From] = natTypeReport{natType: natType, reported: time.Now()}
+
+	if len(r.punches) < recentPunchesSize {
+		r.punches = append(r.punches, rep)
+	} else {
+		r.punches[r.nextPunch] = rep
+	}
+	r.nextPunch = (r.nextPunch + 1) % recentPunchesSize
+	return true
+}
+
+// natType returns the NAT type p reported in its last punch result, or
+// NATUnknown if that was more than natTypeTTL ago.
+func (r *registry) natType(p peer.ID) NATType {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.natTypeLocked(p)
+}
+
+func (r *registry) natTypeLocked(p peer.ID) NATType {
+	t, ok := r.natTypes[p]
+	if !ok || time.Since(t.reported) > natTypeTTL {
+		return NATUnknown
+	}
+	return t.natType
+}
+
+func (r *registry) isBanned(p peer.ID) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	_, ok := r.banned[p]
+	return ok
+}
+
+// Clients returns the peers with an open traversal stream to this node.
+func (b *NatTraversal) Clients() []ClientInfo {
+	b.bootstrapPeers.mux.Lock()
+	ids := make([]peer.ID, 0, len(b.bootstrapPeers.peerList))
+	for p := range b.bootstrapPeers.peerList {
+		ids = append(ids, p)
+	}
+	b.bootstrapPeers.mux.Unlock()
+
+	b.registry.mux.Lock()
+	defer b.registry.mux.Unlock()
+
+	clients := make([]ClientInfo, 0, len(ids))
+	for _, p := range ids {
+		ci := ClientInfo{ID: p, NATType: b.registry.natTypeLocked(p).String()}
+		for _, c := range b.host.Network().ConnsToPeer(p) {
+			ci.Addrs = append(ci.Addrs, c.RemoteMultiaddr())
+		}
+		clients = append(clients, ci)
+	}
+	return clients
+}
+
+// Coordinations returns the punches this node is coordinating.
+func (b *NatTraversal) Coordinations() []Coordination {
+	r := b.registry
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	coords := make([]Coordination, 0, len(r.coords))
+	for k, c := range r.coords {
+		if time.Since(c.Started) > coordinationTTL {
+			delete(r.coords, k)
+			continue
+		}
+		coords = append(coords, *c)
+	}
+	return coords
+}
+
+// RecentPunches returns the last punch results reported to this node,
+// oldest first.
+func (b *NatTraversal) RecentPunches() []PunchReport {
+	r := b.registry
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	out := make([]PunchReport, 0, len(r.punches))
+	if len(r.punches) == recentPunchesSize {
+		out = append(out, r.punches[r.nextPunch:]...)
+		out = append(out, r.punches[:r.nextPunch]...)
+	} else {
+		out = append(out, r.punches...)
+	}
+	return out
+}
+
+// ServiceNodes returns the service nodes this node is connected to.
+func (b *NatTraversal) ServiceNodes() []peer.ID {
+	b.bootstrapPeers.mux.Lock()
+	defer b.bootstrapPeers.mux.Unlock()
+
+	return append([]peer.ID(nil), b.serviceNodes...)
+}
+
+// QueueDepths returns the number of packets waiting to be handled and to
+// be sent.
+func (b *NatTraversal) QueueDepths() (incoming, outgoing int) {
+	return len(b.incoming), len(b.outgoing)
+}
+
+// Kick closes the traversal stream and all connections to p. The peer
+// may connect again unless it is banned.
+func (b *NatTraversal) Kick(p peer.ID) {
+	log.Info("Kicking peer: ", p)
+
+	if sm, ok := b.getStreamWrapper(p); ok {
+		(*sm.s).Reset()
+	}
+	for _, c := range b.host.Network().ConnsToPeer(p) {
+		c.Close()
+	}
+}
+
+// Ban kicks p and refuses its traversal streams and requests until Unban
+// is called.
+func (b *NatTraversal) Ban(p peer.ID) {
+	b.registry.mux.Lock()
+	b.registry.banned[p] = struct{}{}
+	b.registry.mux.Unlock()
+
+	b.Kick(p)
+}
+
+// Unban lifts a ban placed with Ban.
+func (b *NatTraversal) Unban(p peer.ID) {
+	b.registry.mux.Lock()
+	delete(b.registry.banned, p)
+	b.registry.mux.Unlock()
+}
+
+// Banned returns the banned peers.
+func (b *NatTraversal) Banned() []peer.ID {
+	b.registry.mux.Lock()
+	defer b.registry.mux.Unlock()
+
+	out := make([]peer.ID, 0, len(b.registry.banned))
+	for p := range b.registry.banned {
+		out = append(out, p)
+	}
+	return out
+}
@@ -0,0 +1,70 @@
+package ntraversal
+
+import (
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+)
+
+// backoffNetwork is implemented by networks with a dial backoff, such as
+// the swarm.
+type backoffNetwork interface {
+	Backoff() *swarm.DialBackoff
+}
+
+// backoffScopes keep the dial backoff of peers apart from the punch dials
+// going through the swarm, i.e. all dials on hosts without the
+// PunchTransport. The swarm refuses to dial a peer for a while after a
+// failed dial. Punch dials must not be refused because of earlier
+// failures, and their own failures, which are expected, must not make the
+// swarm refuse the dials of the application. While dials to a peer are in
+// flight its backoff is cleared; once the last one is done, the peer is
+// backed off again if it was before and no dial connected.
+type backoffScopes struct {
+	mux   sync.Mutex
+	peers map[peer.ID]*backoffScope
+}
+
+type backoffScope struct {
+	dials     int
+	had       bool
+	connected bool
+}
+
+func newBackoffScopes() *backoffScopes {
+	return &backoffScopes{peers: make(map[peer.ID]*backoffScope)}
+}
+
+// enter starts a dial to p on bo.
+func (s *backoffScopes) enter(bo *swarm.DialBackoff, p peer.ID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	sc, ok := s.peers[p]
+	if !ok {
+		sc = &backoffScope{had: bo.Backoff(p)}
+		s.peers[p] = sc
+	}
+	sc.dials++
+	bo.Clear(p)
+}
+
+// exit ends a dial to p on bo, forgetting the backoff it added if it
+// failed.
+func (s *backoffScopes) exit(bo *swarm.DialBackoff, p peer.ID, connected bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	sc := s.peers[p]
+	sc.dials--
+	sc.connected = sc.connected || connected
+	bo.Clear(p)
+	if sc.dials > 0 {
+		return
+	}
+	delete(s.peers, p)
+	if sc.had && !sc.connected {
+		bo.AddBackoff(p)
+	}
+}
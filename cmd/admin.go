@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+// adminServer serves a JSON API to inspect and manage a running
+// coordinator:
+//
+//	GET    /clients             registered clients
+//	GET    /coordinations       punches in flight
+//	GET    /punches             recent punch results
+//	GET    /service-nodes       connected federation peers
+//	GET    /queues              message queue depths
+//	GET    /bans                banned peers
+//	POST   /peers/<id>/kick     disconnect a peer
+//	POST   /peers/<id>/ban      disconnect and ban a peer
+//	DELETE /peers/<id>/ban      lift a ban
+//
+// If token is set, requests must carry it as a bearer token.
+type adminServer struct {
+	nt    *ntraversal.NatTraversal
+	token string
+}
+
+type clientJSON struct {
+	ID      string   `json:"id"`
+	Addrs   []string `json:"addrs"`
+	NATType string   `json:"natType,omitempty"`
+}
+
+type coordinationJSON struct {
+	Initiator string    `json:"initiator"`
+	Target    string    `json:"target"`
+	Started   time.Time `json:"started"`
+	Reported  int       `json:"reported"`
+}
+
+type punchJSON struct {
+	Time      time.Time `json:"time"`
+	From      string    `json:"from"`
+	Peer      string    `json:"peer"`
+	Success   bool      `json:"success"`
+	Addr      string    `json:"addr,omitempty"`
+	Transport string    `json:"transport,omitempty"`
+	Strategy  string    `json:"strategy,omitempty"`
+	ElapsedMs int64     `json:"elapsedMs"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	NATType   string    `json:"natType,omitempty"`
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+func peerStrings(ids []peer.ID) []string {
+	out := make([]string, 0, len(ids))
+	for _, p := range ids {
+		out = append(out, p.Pretty())
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (as *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", as.get(as.clients))
+	mux.HandleFunc("/coordinations", as.get(as.coordinations))
+	mux.HandleFunc("/punches", as.get(as.punches))
+	mux.HandleFunc("/service-nodes", as.get(as.serviceNodes))
+	mux.HandleFunc("/queues", as.get(as.queues))
+	mux.HandleFunc("/bans", as.get(as.bans))
+	mux.HandleFunc("/peers/", as.peerAction)
+	if as.token == "" {
+		return mux
+	}
+	return as.authorize(mux)
+}
+
+func (as *adminServer) authorize(next http.Handler) http.Handler {
+	want := []byte("Bearer " + as.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (as *adminServer) get(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, f())
+	}
+}
+
+func (as *adminServer) clients() interface{} {
+	var out []clientJSON
+	for _, c := range as.nt.Clients() {
+		out = append(out, clientJSON{
+			ID:      c.ID.Pretty(),
+			Addrs:   addrStrings(c.Addrs),
+			NATType: c.NATType,
+		})
+	}
+	return out
+}
+
+func (as *adminServer) coordinations() interface{} {
+	var out []coordinationJSON
+	for _, c := range as.nt.Coordinations() {
+		out = append(out, coordinationJSON{
+			Initiator: c.Initiator.Pretty(),
+			Target:    c.Target.Pretty(),
+			Started:   c.Started,
+			Reported:  c.Reported,
+		})
+	}
+	return out
+}
+
+func (as *adminServer) punches() interface{} {
+	var out []punchJSON
+	for _, p := range as.nt.RecentPunches() {
+		pj := punchJSON{
+			Time:      p.Time,
+			From:      p.From.Pretty(),
+			Peer:      p.Peer.Pretty(),
+			Success:   p.Success,
+			Transport: p.Transport,
+			Strategy:  p.Strategy,
+			ElapsedMs: int64(p.Elapsed / time.Millisecond),
+			Attempts:  p.Attempts,
+			Error:     p.Error,
+			NATType:   p.NATType,
+		}
+		if p.Addr != nil {
+			pj.Addr = p.Addr.String()
+		}
+		out = append(out, pj)
+	}
+	return out
+}
+
+func (as *adminServer) serviceNodes() interface{} {
+	return peerStrings(as.nt.ServiceNodes())
+}
+
+func (as *adminServer) queues() interface{} {
+	in, out := as.nt.QueueDepths()
+	return map[string]int{"incoming": in, "outgoing": out}
+}
+
+func (as *adminServer) bans() interface{} {
+	return peerStrings(as.nt.Banned())
+}
+
+// peerAction handles /peers/<id>/kick and /peers/<id>/ban.
+func (as *adminServer) peerAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/peers/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	p, err := peer.IDB58Decode(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid peer id: "+err.Error())
+		return
+	}
+
+	switch {
+	case parts[1] == "kick" && r.Method == http.MethodPost:
+		as.nt.Kick(p)
+	case parts[1] == "ban" && r.Method == http.MethodPost:
+		as.nt.Ban(p)
+	case parts[1] == "ban" && r.Method == http.MethodDelete:
+		as.nt.Unban(p)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"peer": p.Pretty()})
+}
+
+func serveAdmin(addr, token string, nt *ntraversal.NatTraversal) {
+	as := &adminServer{nt: nt, token: token}
+
+	log.Info("Serving admin API on: ", addr)
+	if err := http.ListenAndServe(addr, as.handler()); err != nil {
+		log.Error(err)
+	}
+}
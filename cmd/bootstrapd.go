@@ -4,18 +4,31 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	logging "github.com/ipfs/go-log"
 	libp2p "github.com/libp2p/go-libp2p"
-	dht "github.com/libp2p/go-libp2p-kad-dht"
+	circuit "github.com/libp2p/go-libp2p-circuit"
 	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
 	ma "github.com/multiformats/go-multiaddr"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
+	yaml "gopkg.in/yaml.v2"
 
 	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
 )
 
 var log = logging.Logger("nat-traversal")
 
+// drainTimeout bounds how long a shutdown waits for coordinations in
+// flight.
+const drainTimeout = 20 * time.Second
+
 type netNotifiee struct{}
 
 func (nn *netNotifiee) Connected(n inet.Network, c inet.Conn) {
@@ -29,18 +42,43 @@ func (nn *netNotifiee) Listen(n inet.Network, a ma.Multiaddr)      {}
 func (nn *netNotifiee) ListenClose(n inet.Network, a ma.Multiaddr) {}
 
 func main() {
-	logging.SetLogLevel("nat-traversal", "DEBUG")
+	cfg, rotateKey, printConfig, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		out, err := yaml.Marshal(cfg.redacted())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Print(string(out))
+		return
+	}
+
+	logging.SetLogLevel("nat-traversal", cfg.LogLevel)
 
-	port := flag.Int("p", 3000, "port number")
-	flag.Parse()
+	priv, err := loadIdentity(cfg.KeyFile, rotateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	ctx := context.Background()
+	hostOpts, err := hostOptions(cfg)
+	if err != nil {
+		panic(err)
+	}
+	hostOpts = append(hostOpts, libp2p.Identity(priv))
 
 	// libp2p.New constructs a new libp2p Host.
 	// Other options can be added here.
-	sourceMultiAddr, _ := ma.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", *port))
-
-	host, err := libp2p.New(ctx, libp2p.ListenAddrs(sourceMultiAddr))
+	host, err := libp2p.New(ctx, hostOpts...)
 	if err != nil {
 		panic(err)
 	}
@@ -50,12 +88,116 @@ func main() {
 
 	fmt.Println("This node: ", host.ID().Pretty(), " ", host.Addrs())
 
-	d, err := dht.New(ctx, host)
+	d, err := newDHT(ctx, host, cfg)
 	if err != nil {
 		panic(err)
 	}
+	period, _ := cfg.bootstrapPeriod()
+	if err := bootstrapDHT(ctx, host, d, cfg.bootstrapPeers(), period); err != nil {
+		panic(err)
+	}
 
-	ntraversal.NewNatTraversal(ctx, &host, d)
+	opts, err := traversalOptions(cfg)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.MetricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		opts = append(opts, ntraversal.MetricsRegistry(reg))
+		go serveMetrics(cfg.MetricsAddr, reg)
+	}
+
+	nt, err := ntraversal.NewNatTraversal(ctx, host, d, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.AdminAddr != "" {
+		go serveAdmin(cfg.AdminAddr, cfg.AdminToken, nt)
+	}
 
-	select {}
+	hs := &healthServer{
+		host:    host,
+		dht:     d,
+		nt:      nt,
+		needDHT: len(cfg.bootstrapPeers()) > 0,
+	}
+	if cfg.HealthAddr != "" {
+		go serveHealth(cfg.HealthAddr, hs)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Info("Got ", sig, ", draining")
+
+	hs.drain()
+	sctx, scancel := context.WithTimeout(ctx, drainTimeout)
+	defer scancel()
+	if err := nt.Shutdown(sctx); err != nil {
+		log.Error("Shutdown did not drain: ", err)
+	}
+	if err := d.Close(); err != nil {
+		log.Error(err)
+	}
+	if err := host.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+func hostOptions(cfg *Config) ([]libp2p.Option, error) {
+	listen, err := parseAddrs(cfg.ListenAddrs)
+	if err != nil {
+		return nil, err
+	}
+	opts := []libp2p.Option{libp2p.ListenAddrs(listen...)}
+
+	if len(cfg.AnnounceAddrs) > 0 {
+		announce, err := parseAddrs(cfg.AnnounceAddrs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+			return announce
+		}))
+	}
+
+	if cfg.Role.Relay {
+		opts = append(opts, libp2p.EnableRelay(circuit.OptHop))
+	}
+	return opts, nil
+}
+
+func traversalOptions(cfg *Config) ([]ntraversal.Option, error) {
+	var opts []ntraversal.Option
+
+	if cfg.Role.Coordinator {
+		opts = append(opts, ntraversal.BootstrapServer)
+	}
+
+	if cfg.Limit.PerSecond > 0 {
+		opts = append(opts, ntraversal.RateLimit(cfg.Limit.PerSecond, cfg.Limit.Burst))
+	}
+
+	if cfg.Auth.Policy == "allowlist" {
+		allowed, err := cfg.allowedPeers()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ntraversal.Authorize(func(p peer.ID) bool {
+			_, ok := allowed[p]
+			return ok
+		}))
+	}
+	return opts, nil
+}
+
+func serveMetrics(addr string, reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	log.Info("Serving metrics on: ", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error(err)
+	}
 }
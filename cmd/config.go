@@ -0,0 +1,354 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of bootstrapd. It is read from a YAML file
+// given with -config; flags override the values of the file.
+type Config struct {
+	// ListenAddrs are multiaddrs to listen on, e.g. /ip4/0.0.0.0/tcp/3000
+	// or /ip6/::/tcp/3000. QUIC is not supported: the QUIC transport of
+	// this libp2p release panics on start with current Go releases.
+	ListenAddrs []string `yaml:"listen_addrs"`
+	// AnnounceAddrs replace the addresses advertised to other peers.
+	AnnounceAddrs []string `yaml:"announce_addrs,omitempty"`
+	KeyFile       string   `yaml:"key_file"`
+	LogLevel      string   `yaml:"log_level"`
+	MetricsAddr   string   `yaml:"metrics_addr,omitempty"`
+	// AdminAddr serves the admin API, which allows kicking and banning
+	// peers, so it should not be reachable from the internet.
+	AdminAddr string `yaml:"admin_addr,omitempty"`
+	// AdminToken must be sent as a bearer token to the admin API. It is
+	// required unless AdminAddr is a loopback address.
+	AdminToken string `yaml:"admin_token,omitempty"`
+	// HealthAddr serves /healthz and /readyz for container probes.
+	HealthAddr string `yaml:"health_addr,omitempty"`
+
+	DHT   DHTConfig   `yaml:"dht"`
+	Limit LimitConfig `yaml:"rate_limit"`
+	Auth  AuthConfig  `yaml:"auth"`
+	Role  RoleConfig  `yaml:"role"`
+}
+
+// DHTConfig configures the DHT used to look up peers.
+type DHTConfig struct {
+	// Mode is "server" to answer DHT queries of others or "client".
+	Mode string `yaml:"mode"`
+	// Network is "public" to join the IPFS DHT through its bootstrap
+	// nodes as well as BootstrapPeers, or "private" to only use
+	// BootstrapPeers.
+	Network string `yaml:"network"`
+	// Protocol replaces the DHT protocol ID, keeping a private network
+	// apart from the public one.
+	Protocol       string   `yaml:"protocol,omitempty"`
+	BootstrapPeers []string `yaml:"bootstrap_peers,omitempty"`
+	// BootstrapPeriod is the time between bootstrap rounds, e.g. 5m.
+	BootstrapPeriod string `yaml:"bootstrap_period"`
+}
+
+// LimitConfig limits the connection requests per peer. A zero rate
+// disables limiting.
+type LimitConfig struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int     `yaml:"burst"`
+}
+
+// AuthConfig decides which peers may request punches.
+type AuthConfig struct {
+	// Policy is "open" or "allowlist".
+	Policy       string   `yaml:"policy"`
+	AllowedPeers []string `yaml:"allowed_peers,omitempty"`
+}
+
+// RoleConfig selects the services the node offers.
+type RoleConfig struct {
+	Coordinator bool `yaml:"coordinator"`
+	Relay       bool `yaml:"relay"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddrs: []string{"/ip4/0.0.0.0/tcp/3000"},
+		KeyFile:     "bootstrapd.key",
+		LogLevel:    "INFO",
+		DHT:         DHTConfig{Mode: "server", Network: "private", BootstrapPeriod: "5m"},
+		Auth:        AuthConfig{Policy: "open"},
+		Role:        RoleConfig{Coordinator: true},
+	}
+}
+
+func loadConfig(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("cannot parse config %s: %s", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if len(cfg.ListenAddrs) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	for _, group := range [][]string{cfg.ListenAddrs, cfg.AnnounceAddrs} {
+		if _, err := parseAddrs(group); err != nil {
+			return err
+		}
+	}
+	listen, _ := parseAddrs(cfg.ListenAddrs)
+	for _, addr := range listen {
+		if _, err := addr.ValueForProtocol(ma.P_QUIC); err == nil {
+			return fmt.Errorf("cannot listen on %s: QUIC is not supported", addr)
+		}
+	}
+	for _, a := range cfg.DHT.BootstrapPeers {
+		addr, err := ma.NewMultiaddr(a)
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap peer %q: %s", a, err)
+		}
+		if _, err := addr.ValueForProtocol(ma.P_IPFS); err != nil {
+			return fmt.Errorf("bootstrap peer %q has no peer id", a)
+		}
+	}
+	if cfg.KeyFile == "" {
+		return fmt.Errorf("no key file")
+	}
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" && !isLoopback(cfg.AdminAddr) {
+		return fmt.Errorf("admin API on %s needs an admin token unless it listens on a loopback address", cfg.AdminAddr)
+	}
+
+	switch strings.ToUpper(cfg.LogLevel) {
+	case "DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL":
+	default:
+		return fmt.Errorf("invalid log level: %s", cfg.LogLevel)
+	}
+
+	switch cfg.DHT.Mode {
+	case "server", "client":
+	default:
+		return fmt.Errorf("invalid dht mode %q, want server or client", cfg.DHT.Mode)
+	}
+	switch cfg.DHT.Network {
+	case "public":
+		if cfg.DHT.Protocol != "" {
+			return fmt.Errorf("the public dht network does not allow a custom protocol")
+		}
+	case "private":
+	default:
+		return fmt.Errorf("invalid dht network %q, want public or private", cfg.DHT.Network)
+	}
+	if cfg.DHT.Protocol != "" && !strings.HasPrefix(cfg.DHT.Protocol, "/") {
+		return fmt.Errorf("invalid dht protocol %q, want e.g. /myapp/kad/1.0.0", cfg.DHT.Protocol)
+	}
+	if _, err := cfg.bootstrapPeriod(); err != nil {
+		return err
+	}
+
+	if cfg.Limit.PerSecond < 0 || (cfg.Limit.PerSecond > 0 && cfg.Limit.Burst <= 0) {
+		return fmt.Errorf("invalid rate limit: %v/s with burst %d", cfg.Limit.PerSecond, cfg.Limit.Burst)
+	}
+
+	switch cfg.Auth.Policy {
+	case "open":
+	case "allowlist":
+		if len(cfg.Auth.AllowedPeers) == 0 {
+			return fmt.Errorf("allowlist auth policy without allowed peers")
+		}
+	default:
+		return fmt.Errorf("invalid auth policy %q, want open or allowlist", cfg.Auth.Policy)
+	}
+	if _, err := cfg.allowedPeers(); err != nil {
+		return err
+	}
+
+	if !cfg.Role.Coordinator && !cfg.Role.Relay {
+		return fmt.Errorf("node has neither the coordinator nor the relay role")
+	}
+	return nil
+}
+
+// isLoopback reports whether the host of addr, a host:port pair, is a
+// loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (cfg *Config) bootstrapPeriod() (time.Duration, error) {
+	d, err := time.ParseDuration(cfg.DHT.BootstrapPeriod)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid dht bootstrap period %q", cfg.DHT.BootstrapPeriod)
+	}
+	return d, nil
+}
+
+// bootstrapPeers returns the DHT bootstrap peers including the public
+// ones when joining the public network.
+func (cfg *Config) bootstrapPeers() []string {
+	peers := append([]string(nil), cfg.DHT.BootstrapPeers...)
+	if cfg.DHT.Network == "public" {
+		peers = append(peers, publicBootstrapPeers...)
+	}
+	return peers
+}
+
+func (cfg *Config) allowedPeers() (map[peer.ID]struct{}, error) {
+	allowed := make(map[peer.ID]struct{}, len(cfg.Auth.AllowedPeers))
+	for _, s := range cfg.Auth.AllowedPeers {
+		id, err := peer.IDB58Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed peer %q: %s", s, err)
+		}
+		allowed[id] = struct{}{}
+	}
+	return allowed, nil
+}
+
+func parseAddrs(addrs []string) ([]ma.Multiaddr, error) {
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		addr, err := ma.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %s", a, err)
+		}
+		out = append(out, addr)
+	}
+	return out, nil
+}
+
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(v string) error {
+	*i = append(*i, v)
+	return nil
+}
+
+// redacted returns a copy of cfg without secrets, for printing.
+func (cfg *Config) redacted() *Config {
+	out := *cfg
+	if out.AdminToken != "" {
+		out.AdminToken = "REDACTED"
+	}
+	return &out
+}
+
+// parseFlags builds the configuration from the defaults, the config file
+// and the flags in args, in increasing precedence. It also returns whether
+// the key should be rotated and the config printed.
+func parseFlags(args []string) (cfg *Config, rotateKey bool, printConfig bool, err error) {
+	var (
+		listen, announce, bootstrap, allow arrayFlags
+	)
+
+	fs := flag.NewFlagSet("bootstrapd", flag.ContinueOnError)
+	configFile := fs.String("config", "", "YAML config file")
+	port := fs.Int("p", 0, "listen on this TCP port on all IPv4 interfaces (shorthand for -listen)")
+	fs.Var(&listen, "listen", "multiaddr to listen on, repeatable")
+	fs.Var(&announce, "announce", "multiaddr to announce instead of the listen addresses, repeatable")
+	keyFile := fs.String("key", "", "private key file, created if missing")
+	rotate := fs.Bool("rotate-key", false, "replace the private key with a new one, changing the peer ID")
+	logLevel := fs.String("log-level", "", "log level: DEBUG, INFO, WARNING, ERROR or CRITICAL")
+	metricsAddr := fs.String("metrics", "", "serve prometheus metrics on this address, e.g. :9090")
+	adminAddr := fs.String("admin", "", "serve the admin API on this address, e.g. 127.0.0.1:9091")
+	adminToken := fs.String("admin-token", "", "bearer token required by the admin API, needed unless it listens on loopback")
+	healthAddr := fs.String("health", "", "serve health checks on this address, e.g. :8080")
+	dhtMode := fs.String("dht-mode", "", "DHT mode: server or client")
+	dhtNetwork := fs.String("dht-network", "", "DHT network: public or private")
+	dhtProtocol := fs.String("dht-protocol", "", "DHT protocol ID of a private network")
+	dhtPeriod := fs.String("dht-bootstrap-period", "", "time between DHT bootstrap rounds, e.g. 5m")
+	fs.Var(&bootstrap, "bootstrap", "DHT bootstrap peer multiaddr, repeatable")
+	rateLimit := fs.Float64("rate-limit", 0, "connection requests per second allowed per peer, 0 for no limit")
+	rateBurst := fs.Int("rate-burst", 0, "connection request burst allowed per peer")
+	authPolicy := fs.String("auth", "", "auth policy: open or allowlist")
+	fs.Var(&allow, "allow", "peer ID allowed by the allowlist policy, repeatable")
+	coordinator := fs.Bool("coordinator", true, "coordinate hole punching for clients")
+	relay := fs.Bool("relay", false, "act as a circuit relay")
+	printCfg := fs.Bool("print-config", false, "print the effective config and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, false, err
+	}
+
+	cfg = defaultConfig()
+	if *configFile != "" {
+		if err := loadConfig(*configFile, cfg); err != nil {
+			return nil, false, false, err
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			listen = append(listen, fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", *port))
+		case "key":
+			cfg.KeyFile = *keyFile
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "metrics":
+			cfg.MetricsAddr = *metricsAddr
+		case "admin":
+			cfg.AdminAddr = *adminAddr
+		case "admin-token":
+			cfg.AdminToken = *adminToken
+		case "health":
+			cfg.HealthAddr = *healthAddr
+		case "dht-mode":
+			cfg.DHT.Mode = *dhtMode
+		case "dht-network":
+			cfg.DHT.Network = *dhtNetwork
+		case "dht-protocol":
+			cfg.DHT.Protocol = *dhtProtocol
+		case "dht-bootstrap-period":
+			cfg.DHT.BootstrapPeriod = *dhtPeriod
+		case "rate-limit":
+			cfg.Limit.PerSecond = *rateLimit
+		case "rate-burst":
+			cfg.Limit.Burst = *rateBurst
+		case "auth":
+			cfg.Auth.Policy = *authPolicy
+		case "coordinator":
+			cfg.Role.Coordinator = *coordinator
+		case "relay":
+			cfg.Role.Relay = *relay
+		}
+	})
+	if len(listen) > 0 {
+		cfg.ListenAddrs = listen
+	}
+	if len(announce) > 0 {
+		cfg.AnnounceAddrs = announce
+	}
+	if len(bootstrap) > 0 {
+		cfg.DHT.BootstrapPeers = bootstrap
+	}
+	if len(allow) > 0 {
+		cfg.Auth.AllowedPeers = allow
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, false, false, err
+	}
+	return cfg, *rotate, *printCfg, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPeerID = "QmQnAZsyiJSovuqg8zjP3nKdm6Pwb75Mpn8HnGyD5WYZ15"
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(*Config)
+		// err is a fragment of the error, empty if valid.
+		err string
+	}{
+		{"default", func(*Config) {}, ""},
+		{"no listen address", func(c *Config) { c.ListenAddrs = nil }, "no listen address"},
+		{"invalid listen address", func(c *Config) { c.ListenAddrs = []string{"tcp/3000"} }, "invalid address"},
+		{"quic", func(c *Config) { c.ListenAddrs = []string{"/ip4/0.0.0.0/udp/3000/quic"} }, "QUIC is not supported"},
+		{"invalid announce address", func(c *Config) { c.AnnounceAddrs = []string{"nope"} }, "invalid address"},
+		{"bootstrap peer", func(c *Config) { c.DHT.BootstrapPeers = []string{"/ip4/1.2.3.4/tcp/3000/ipfs/" + testPeerID} }, ""},
+		{"bootstrap peer without id", func(c *Config) { c.DHT.BootstrapPeers = []string{"/ip4/1.2.3.4/tcp/3000"} }, "has no peer id"},
+		{"no key file", func(c *Config) { c.KeyFile = "" }, "no key file"},
+		{"admin on loopback", func(c *Config) { c.AdminAddr = "127.0.0.1:9091" }, ""},
+		{"admin on localhost", func(c *Config) { c.AdminAddr = "localhost:9091" }, ""},
+		{"admin without token", func(c *Config) { c.AdminAddr = ":9091" }, "needs an admin token"},
+		{"admin with token", func(c *Config) { c.AdminAddr = ":9091"; c.AdminToken = "secret" }, ""},
+		{"log level", func(c *Config) { c.LogLevel = "debug" }, ""},
+		{"invalid log level", func(c *Config) { c.LogLevel = "LOUD" }, "invalid log level"},
+		{"invalid dht mode", func(c *Config) { c.DHT.Mode = "peer" }, "invalid dht mode"},
+		{"invalid dht network", func(c *Config) { c.DHT.Network = "lan" }, "invalid dht network"},
+		{"public dht protocol", func(c *Config) { c.DHT.Network = "public"; c.DHT.Protocol = "/app/kad/1.0.0" }, "does not allow a custom protocol"},
+		{"invalid dht protocol", func(c *Config) { c.DHT.Protocol = "app" }, "invalid dht protocol"},
+		{"invalid bootstrap period", func(c *Config) { c.DHT.BootstrapPeriod = "0s" }, "invalid dht bootstrap period"},
+		{"negative rate limit", func(c *Config) { c.Limit.PerSecond = -1 }, "invalid rate limit"},
+		{"rate limit without burst", func(c *Config) { c.Limit.PerSecond = 1 }, "invalid rate limit"},
+		{"invalid auth policy", func(c *Config) { c.Auth.Policy = "closed" }, "invalid auth policy"},
+		{"empty allowlist", func(c *Config) { c.Auth.Policy = "allowlist" }, "without allowed peers"},
+		{"invalid allowed peer", func(c *Config) { c.Auth.Policy = "allowlist"; c.Auth.AllowedPeers = []string{"nope"} }, "invalid allowed peer"},
+		{"no role", func(c *Config) { c.Role.Coordinator = false }, "neither the coordinator nor the relay role"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			c.change(cfg)
+			err := cfg.validate()
+			if c.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got %v, want an error with %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bootstrapd.yaml")
+	err := ioutil.WriteFile(file, []byte(`
+listen_addrs:
+  - /ip4/0.0.0.0/tcp/4000
+key_file: file.key
+log_level: ERROR
+dht:
+  mode: client
+  network: private
+  bootstrap_period: 1m
+role:
+  coordinator: true
+  relay: true
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		args  []string
+		check func(*Config) bool
+	}{
+		{"defaults", nil, func(c *Config) bool {
+			return c.KeyFile == "bootstrapd.key" && c.ListenAddrs[0] == "/ip4/0.0.0.0/tcp/3000" && c.Role.Coordinator && !c.Role.Relay
+		}},
+		{"file over defaults", []string{"-config", file}, func(c *Config) bool {
+			return c.KeyFile == "file.key" && c.LogLevel == "ERROR" && c.DHT.Mode == "client" && c.Role.Relay
+		}},
+		{"flags over file", []string{"-config", file, "-key", "flag.key", "-log-level", "DEBUG", "-dht-mode", "server", "-relay=false"}, func(c *Config) bool {
+			return c.KeyFile == "flag.key" && c.LogLevel == "DEBUG" && c.DHT.Mode == "server" && !c.Role.Relay
+		}},
+		{"unset flags keep the file", []string{"-config", file, "-metrics", ":9090"}, func(c *Config) bool {
+			return c.KeyFile == "file.key" && c.DHT.BootstrapPeriod == "1m" && c.Role.Relay && c.MetricsAddr == ":9090"
+		}},
+		{"listen flags replace the file", []string{"-config", file, "-p", "5000", "-listen", "/ip6/::/tcp/5000"}, func(c *Config) bool {
+			return len(c.ListenAddrs) == 2 && c.ListenAddrs[0] == "/ip6/::/tcp/5000" && c.ListenAddrs[1] == "/ip4/0.0.0.0/tcp/5000"
+		}},
+		{"repeated flags", []string{"-auth", "allowlist", "-allow", testPeerID, "-allow", testPeerID}, func(c *Config) bool {
+			return c.Auth.Policy == "allowlist" && len(c.Auth.AllowedPeers) == 2
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, _, _, err := parseFlags(c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.check(cfg) {
+				t.Fatalf("unexpected config %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"unknown flag", []string{"-bogus"}},
+		{"missing file", []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}},
+		{"invalid value", []string{"-dht-mode", "peer"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, _, err := parseFlags(c.args); err == nil {
+				t.Fatal("parsed")
+			}
+		})
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "secret"
+
+	if r := cfg.redacted(); r.AdminToken == "secret" || r.AdminToken == "" {
+		t.Fatalf("admin token %q, want it redacted", r.AdminToken)
+	}
+	if cfg.AdminToken != "secret" {
+		t.Fatal("redacted changed the config")
+	}
+	if r := defaultConfig().redacted(); r.AdminToken != "" {
+		t.Fatalf("admin token %q without a token", r.AdminToken)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p-host"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// publicBootstrapPeers are the bootstrap nodes of the public IPFS DHT.
+var publicBootstrapPeers = []string{
+	"/dnsaddr/bootstrap.libp2p.io/ipfs/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/ipfs/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/ipfs/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/ipfs/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+	"/ip4/104.131.131.82/tcp/4001/ipfs/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+}
+
+const (
+	// bootstrapDialTimeout bounds a connection to one bootstrap peer.
+	bootstrapDialTimeout = 15 * time.Second
+	// minRoutingPeers is the routing table size below which the bootstrap
+	// peers are dialed again.
+	minRoutingPeers = 4
+)
+
+func newDHT(ctx context.Context, h host.Host, cfg *Config) (*dht.IpfsDHT, error) {
+	opts := []dhtopts.Option{dhtopts.Client(cfg.DHT.Mode == "client")}
+	if cfg.DHT.Protocol != "" {
+		opts = append(opts, dhtopts.Protocols(protocol.ID(cfg.DHT.Protocol)))
+	}
+	return dht.New(ctx, h, opts...)
+}
+
+// bootstrapDHT connects to the bootstrap peers and starts the periodic
+// bootstrap rounds of d, which refresh its routing table. Whenever the
+// routing table runs low the bootstrap peers are dialed again. It returns
+// once the first connections were attempted and keeps running until ctx
+// is done.
+func bootstrapDHT(ctx context.Context, h host.Host, d *dht.IpfsDHT, peers []string, period time.Duration) error {
+	pis, err := bootstrapPeerInfos(peers)
+	if err != nil {
+		return err
+	}
+	if len(pis) == 0 {
+		log.Info("No DHT bootstrap peers, peers are only found when they connect")
+		return nil
+	}
+
+	connectBootstrapPeers(ctx, h, pis)
+
+	bcfg := dht.DefaultBootstrapConfig
+	bcfg.Period = period
+	if err := d.BootstrapWithConfig(ctx, bcfg); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if d.RoutingTable().Size() < minRoutingPeers {
+					connectBootstrapPeers(ctx, h, pis)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func bootstrapPeerInfos(peers []string) ([]pstore.PeerInfo, error) {
+	pis := make([]pstore.PeerInfo, 0, len(peers))
+	for _, s := range peers {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, err
+		}
+		pi, err := pstore.InfoFromP2pAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		pis = append(pis, *pi)
+	}
+	return pis, nil
+}
+
+func connectBootstrapPeers(ctx context.Context, h host.Host, pis []pstore.PeerInfo) {
+	var wg sync.WaitGroup
+	for _, pi := range pis {
+		wg.Add(1)
+		go func(pi pstore.PeerInfo) {
+			defer wg.Done()
+
+			cctx, cancel := context.WithTimeout(ctx, bootstrapDialTimeout)
+			defer cancel()
+			if err := h.Connect(cctx, pi); err != nil {
+				log.Error("Bootstrap peer ", pi.ID, " unreachable: ", err)
+				return
+			}
+			log.Info("Connected to bootstrap peer: ", pi.ID)
+		}(pi)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	host "github.com/libp2p/go-libp2p-host"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	inet "github.com/libp2p/go-libp2p-net"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+// newTestDHT returns a host of mn running the DHT configured by cfg.
+func newTestDHT(ctx context.Context, t *testing.T, mn mocknet.Mocknet, cfg *Config) (host.Host, *dht.IpfsDHT) {
+	t.Helper()
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDHT(ctx, h, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return h, d
+}
+
+// p2pAddr returns the bootstrap peer address of h.
+func p2pAddr(h host.Host) string {
+	return h.Addrs()[0].String() + "/ipfs/" + h.ID().Pretty()
+}
+
+// eventually fails unless cond holds within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBootstrapDHTFindsPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	boot, _ := newTestDHT(ctx, t, mn, defaultConfig())
+	ha, da := newTestDHT(ctx, t, mn, defaultConfig())
+	hb, db := newTestDHT(ctx, t, mn, defaultConfig())
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []struct {
+		h host.Host
+		d *dht.IpfsDHT
+	}{{ha, da}, {hb, db}} {
+		if err := bootstrapDHT(ctx, n.h, n.d, []string{p2pAddr(boot)}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if n.h.Network().Connectedness(boot.ID()) != inet.Connected {
+			t.Fatal("not connected to the bootstrap peer")
+		}
+	}
+	if ha.Network().Connectedness(hb.ID()) == inet.Connected {
+		t.Fatal("peers connected before looking each other up")
+	}
+
+	fctx, fcancel := context.WithTimeout(ctx, 5*time.Second)
+	defer fcancel()
+	pi, err := da.FindPeer(fctx, hb.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.ID != hb.ID() || len(pi.Addrs) == 0 {
+		t.Fatalf("found %v, want %s with its addresses", pi, hb.ID())
+	}
+}
+
+func TestBootstrapDHTReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	// The bootstrap peer runs no DHT, so only the bootstrap rounds dial it.
+	boot, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, d := newTestDHT(ctx, t, mn, defaultConfig())
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bootstrapDHT(ctx, h, d, []string{p2pAddr(boot)}, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Network().ClosePeer(boot.ID()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the bootstrap peer to disconnect", func() bool {
+		return h.Network().Connectedness(boot.ID()) != inet.Connected
+	})
+	// The routing table is now below minRoutingPeers.
+	eventually(t, "the bootstrap peer to be dialed again", func() bool {
+		return h.Network().Connectedness(boot.ID()) == inet.Connected
+	})
+}
+
+func TestBootstrapDHTPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	h, d := newTestDHT(ctx, t, mn, defaultConfig())
+
+	if err := bootstrapDHT(ctx, h, d, nil, time.Minute); err != nil {
+		t.Fatalf("without bootstrap peers: %s", err)
+	}
+	if err := bootstrapDHT(ctx, h, d, []string{"/ip4/1.2.3.4/tcp/3000"}, time.Minute); err == nil {
+		t.Fatal("bootstrapped from a peer without id")
+	}
+}
+
+func TestHealthWaitsForDHT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+
+	cfg := defaultConfig()
+	boot, _ := newTestDHT(ctx, t, mn, cfg)
+	h, d := newTestDHT(ctx, t, mn, cfg)
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := traversalOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt, err := ntraversal.NewNatTraversal(ctx, h, d, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nt.Close()
+
+	hs := &healthServer{host: h, dht: d, nt: nt, needDHT: true}
+	ready := func() (int, readyJSON) {
+		rec := httptest.NewRecorder()
+		hs.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var res readyJSON
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, res
+	}
+
+	code, res := ready()
+	if code != http.StatusServiceUnavailable || res.Ready || res.Checks["dht"] != errDHTEmpty.Error() {
+		t.Fatalf("ready before bootstrap: %d %+v", code, res)
+	}
+
+	if err := bootstrapDHT(ctx, h, d, []string{p2pAddr(boot)}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "readiness", func() bool {
+		code, res = ready()
+		return code == http.StatusOK && res.Ready
+	})
+}
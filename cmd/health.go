@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	host "github.com/libp2p/go-libp2p-host"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+// healthServer answers liveness and readiness probes:
+//
+//	GET /healthz  200 while the process runs
+//	GET /readyz   200 when all checks pass, 503 otherwise
+type healthServer struct {
+	host host.Host
+	dht  *dht.IpfsDHT
+	nt   *ntraversal.NatTraversal
+
+	// needDHT makes readiness wait for a non-empty routing table. It is
+	// only set when bootstrap peers are configured.
+	needDHT bool
+
+	draining int32
+}
+
+var (
+	errDraining     = fmt.Errorf("shutting down")
+	errNotListening = fmt.Errorf("no listen addresses")
+	errDHTEmpty     = fmt.Errorf("dht routing table is empty")
+)
+
+type readyJSON struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (hs *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", hs.healthz)
+	mux.HandleFunc("/readyz", hs.readyz)
+	return mux
+}
+
+// drain makes readiness fail so load balancers stop sending new clients.
+func (hs *healthServer) drain() {
+	atomic.StoreInt32(&hs.draining, 1)
+}
+
+func (hs *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (hs *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	res := readyJSON{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+			return
+		}
+		res.Checks[name] = "ok"
+	}
+
+	if atomic.LoadInt32(&hs.draining) == 1 {
+		check("draining", errDraining)
+	}
+	if len(hs.host.Network().ListenAddresses()) == 0 {
+		check("listening", errNotListening)
+	} else {
+		check("listening", nil)
+	}
+	if hs.needDHT {
+		if hs.dht.RoutingTable().Size() == 0 {
+			check("dht", errDHTEmpty)
+		} else {
+			check("dht", nil)
+		}
+	}
+	check("traversal", hs.nt.Ready())
+
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, res)
+}
+
+func serveHealth(addr string, hs *healthServer) {
+	log.Info("Serving health checks on: ", addr)
+	if err := http.ListenAndServe(addr, hs.handler()); err != nil {
+		log.Error(err)
+	}
+}
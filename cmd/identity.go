@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// loadIdentity reads the private key of the node from path, generating
+// and storing a new one if the file does not exist. With rotate set a new
+// key always replaces the old one, which is kept in path.old, or in
+// path.old.<time> if path.old already exists.
+func loadIdentity(path string, rotate bool) (crypto.PrivKey, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return generateIdentity(path, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %s is accessible by others (mode %s), run chmod 600 on it", path, fi.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if rotate {
+		return rotateIdentity(path, data)
+	}
+	priv, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file %s: %s", path, err)
+	}
+	return priv, nil
+}
+
+// rotateIdentity backs up the key data of path and replaces it with a new
+// key. An existing backup is never overwritten.
+func rotateIdentity(path string, data []byte) (crypto.PrivKey, error) {
+	backup := path + ".old"
+	if _, err := os.Stat(backup); err == nil {
+		backup = path + ".old." + time.Now().Format("20060102T150405")
+	}
+
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot back up key file %s: %s", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(backup)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(backup)
+		return nil, err
+	}
+
+	priv, err := generateIdentity(path, true)
+	if err != nil {
+		os.Remove(backup)
+		return nil, err
+	}
+	log.Warning("Rotated identity, previous key kept in: ", backup)
+	return priv, nil
+}
+
+// generateIdentity stores a new key in path. The key is written to a
+// temporary file first, so path always holds a complete key or none. Unless
+// replace is set an existing path is never overwritten.
+func generateIdentity(path string, replace bool) (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	// TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if replace {
+		err = os.Rename(f.Name(), path)
+	} else {
+		// Link fails if a key was created concurrently.
+		err = os.Link(f.Name(), path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Generated new identity ", id.Pretty(), " in: ", path)
+	return priv, nil
+}
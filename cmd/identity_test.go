@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+)
+
+// readKey reads the key stored in path.
+func readKey(t *testing.T, path string) crypto.PrivKey {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// checkNoTempFiles fails if a temporary key file was left in dir.
+func checkNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if strings.Contains(fi.Name(), ".tmp") {
+			t.Fatalf("temporary file %s left", fi.Name())
+		}
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bootstrapd.key")
+
+	priv, err := loadIdentity(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %s, want 0600", fi.Mode().Perm())
+	}
+	if !readKey(t, path).Equals(priv) {
+		t.Fatal("stored key differs from the generated one")
+	}
+
+	loaded, err := loadIdentity(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equals(priv) {
+		t.Fatal("loaded a different key")
+	}
+	checkNoTempFiles(t, dir)
+}
+
+func TestLoadIdentityRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bootstrapd.key")
+
+	first, err := loadIdentity(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".old"); !os.IsNotExist(err) {
+		t.Fatal("backed up a key which did not exist")
+	}
+
+	second, err := loadIdentity(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Equals(first) {
+		t.Fatal("key not rotated")
+	}
+	if !readKey(t, path).Equals(second) {
+		t.Fatal("stored key differs from the rotated one")
+	}
+	if !readKey(t, path+".old").Equals(first) {
+		t.Fatal("previous key not kept")
+	}
+
+	third, err := loadIdentity(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readKey(t, path+".old").Equals(first) {
+		t.Fatal("first backup overwritten")
+	}
+	backups, err := filepath.Glob(path + ".old.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || !readKey(t, backups[0]).Equals(second) {
+		t.Fatalf("backups %v, want one holding the second key", backups)
+	}
+	if !readKey(t, path).Equals(third) {
+		t.Fatal("stored key differs from the rotated one")
+	}
+	checkNoTempFiles(t, dir)
+}
+
+func TestLoadIdentityErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		// setup prepares the key file path.
+		setup  func(t *testing.T, path string)
+		rotate bool
+	}{
+		{"accessible by others", func(t *testing.T, path string) {
+			if err := ioutil.WriteFile(path, []byte("key"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"rotate accessible by others", func(t *testing.T, path string) {
+			if err := ioutil.WriteFile(path, []byte("key"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"invalid key", func(t *testing.T, path string) {
+			if err := ioutil.WriteFile(path, []byte("key"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"no directory", func(t *testing.T, path string) {
+			if err := os.Remove(filepath.Dir(path)); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bootstrapd.key")
+			c.setup(t, path)
+			before, _ := ioutil.ReadFile(path)
+
+			if _, err := loadIdentity(path, c.rotate); err == nil {
+				t.Fatal("loaded")
+			}
+			if after, _ := ioutil.ReadFile(path); string(after) != string(before) {
+				t.Fatal("key file changed")
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+// Command ntctl diagnoses NAT traversal from the command line.
+//
+//	ntctl -b <service node> nat-type
+//	ntctl -b <service node> punch <peer>
+//	ntctl -b <service node> ping <peer>
+//
+// Add -json for machine readable output.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	libp2p "github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
+	host "github.com/libp2p/go-libp2p-host"
+	peer "github.com/libp2p/go-libp2p-peer"
+	ping "github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(v string) error {
+	*i = append(*i, v)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: ntctl [flags] <command> [args]
+
+Commands:
+  nat-type      detect the NAT type through the service nodes
+  punch <peer>  connect to a peer through the service nodes and print a timeline
+  ping <peer>   connect to a peer like punch, then ping it
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+type client struct {
+	host host.Host
+	nt   *ntraversal.NatTraversal
+	json bool
+	out  io.Writer
+}
+
+func main() {
+	var serviceNodes arrayFlags
+	flag.Var(&serviceNodes, "b", "service node multiaddr, repeatable")
+	port := flag.Int("p", 0, "TCP port to listen on, 0 for any")
+	jsonOut := flag.Bool("json", false, "print JSON")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of the command")
+	count := flag.Int("c", 3, "number of pings")
+	verbose := flag.Bool("v", false, "print traversal logs")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || len(serviceNodes) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		logging.SetLogLevel("nat-traversal", "CRITICAL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	c, err := newClient(ctx, *port, serviceNodes)
+	if err != nil {
+		fail(err)
+	}
+	c.json = *jsonOut
+
+	switch cmd := flag.Arg(0); cmd {
+	case "nat-type":
+		err = c.natType(ctx)
+	case "punch":
+		err = c.withPeer(ctx, c.punch)
+	case "ping":
+		err = c.withPeer(ctx, func(ctx context.Context, p peer.ID) error {
+			return c.ping(ctx, p, *count)
+		})
+	default:
+		err = fmt.Errorf("unknown command: %s", cmd)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "ntctl:", err)
+	os.Exit(1)
+}
+
+func newClient(ctx context.Context, port int, serviceNodes []string) (*client, error) {
+	listen, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port))
+	if err != nil {
+		return nil, err
+	}
+	var nt *ntraversal.NatTraversal
+	h, err := libp2p.New(ctx, libp2p.ListenAddrs(listen), ntraversal.Libp2p(&nt, nil))
+	if err != nil {
+		return nil, err
+	}
+	nt.ConnectToServiceNodes(ctx, serviceNodes)
+	if len(nt.ServiceNodes()) == 0 {
+		return nil, fmt.Errorf("could not connect to any service node")
+	}
+	return &client{host: h, nt: nt, out: os.Stdout}, nil
+}
+
+func (c *client) withPeer(ctx context.Context, f func(context.Context, peer.ID) error) error {
+	if flag.NArg() != 2 {
+		return fmt.Errorf("%s needs a peer ID", flag.Arg(0))
+	}
+	p, err := peer.IDB58Decode(flag.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %s", err)
+	}
+	return f(ctx, p)
+}
+
+// print writes v as JSON with -json and text otherwise.
+func (c *client) print(v interface{}, text string) {
+	if c.json {
+		out, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Fprintln(c.out, string(out))
+		return
+	}
+	fmt.Fprint(c.out, text)
+}
+
+type natTypeJSON struct {
+	NATType  string            `json:"natType"`
+	Observed map[string]string `json:"observed"`
+	Local    []string          `json:"local"`
+}
+
+func (c *client) natType(ctx context.Context) error {
+	rep, err := c.nt.DetectNAT(ctx)
+	if err != nil {
+		return err
+	}
+
+	out := natTypeJSON{
+		NATType:  rep.Type.String(),
+		Observed: make(map[string]string, len(rep.Observed)),
+	}
+	var text strings.Builder
+	fmt.Fprintf(&text, "NAT type: %s\n", rep.Type)
+	for sn, addr := range rep.Observed {
+		out.Observed[sn.Pretty()] = addr.String()
+		fmt.Fprintf(&text, "  %s sees us at %s\n", sn.Pretty(), addr)
+	}
+	for _, addr := range rep.Local {
+		out.Local = append(out.Local, addr.String())
+	}
+	c.print(out, text.String())
+	return nil
+}
+
+type stepJSON struct {
+	AtMs     int64    `json:"atMs"`
+	Event    string   `json:"event"`
+	Attempt  int      `json:"attempt,omitempty"`
+	Addrs    []string `json:"addrs,omitempty"`
+	Strategy string   `json:"strategy,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type punchJSON struct {
+	Peer      string     `json:"peer"`
+	Success   bool       `json:"success"`
+	Addr      string     `json:"addr,omitempty"`
+	Transport string     `json:"transport,omitempty"`
+	Strategy  string     `json:"strategy,omitempty"`
+	ElapsedMs int64      `json:"elapsedMs"`
+	Error     string     `json:"error,omitempty"`
+	Timeline  []stepJSON `json:"timeline"`
+}
+
+func (c *client) punch(ctx context.Context, p peer.ID) error {
+	res, err := c.connect(ctx, p)
+	if err != nil {
+		return err
+	}
+	c.printPunch(p, res)
+
+	if !res.Success {
+		return fmt.Errorf("punch failed")
+	}
+	return nil
+}
+
+// printPunch prints the timeline of the punch to p.
+func (c *client) printPunch(p peer.ID, res *punchJSON) {
+	var text strings.Builder
+	for _, s := range res.Timeline {
+		fmt.Fprintf(&text, "%7dms  %s", s.AtMs, s.Event)
+		if s.Attempt > 0 {
+			fmt.Fprintf(&text, " #%d", s.Attempt)
+		}
+		if len(s.Addrs) > 0 {
+			fmt.Fprintf(&text, " %s", strings.Join(s.Addrs, " "))
+		}
+		if s.Strategy != "" {
+			fmt.Fprintf(&text, " via %s", s.Strategy)
+		}
+		if s.Error != "" {
+			fmt.Fprintf(&text, ": %s", s.Error)
+		}
+		fmt.Fprintln(&text)
+	}
+	if res.Success {
+		fmt.Fprintf(&text, "Connected to %s at %s via %s in %dms\n", p.Pretty(), res.Addr, res.Strategy, res.ElapsedMs)
+	} else {
+		fmt.Fprintf(&text, "Failed to connect to %s: %s\n", p.Pretty(), res.Error)
+	}
+	c.print(res, text.String())
+}
+
+// connect punches to p and returns the timeline of the punch.
+func (c *client) connect(ctx context.Context, p peer.ID) (*punchJSON, error) {
+	res, err := c.nt.Punch(ctx, p)
+	return punchTimeline(p, res, err)
+}
+
+// punchTimeline returns the timeline of the punch to p which returned res
+// and err. Errors other than a *PunchError are returned as is.
+func punchTimeline(p peer.ID, res *ntraversal.PunchResult, err error) (*punchJSON, error) {
+	out := &punchJSON{Peer: p.Pretty(), Success: err == nil}
+	if err != nil {
+		perr, ok := err.(*ntraversal.PunchError)
+		if !ok {
+			return nil, err
+		}
+		out.Error = perr.Err.Error()
+		res = perr.Result
+	}
+	out.ElapsedMs = int64(res.Elapsed / time.Millisecond)
+	out.Strategy = res.Strategy
+	out.Transport = res.Transport
+	if res.Addr != nil {
+		out.Addr = res.Addr.String()
+	}
+
+	for _, s := range res.Trace {
+		step := stepJSON{
+			AtMs:     int64(s.Time.Sub(res.Start) / time.Millisecond),
+			Event:    s.Name,
+			Attempt:  s.Attempt,
+			Strategy: s.Strategy,
+		}
+		for _, a := range s.Addrs {
+			step.Addrs = append(step.Addrs, a.String())
+		}
+		if s.Err != nil {
+			step.Error = s.Err.Error()
+		}
+		out.Timeline = append(out.Timeline, step)
+	}
+	return out, nil
+}
+
+type pingJSON struct {
+	Peer   string  `json:"peer"`
+	Addr   string  `json:"addr,omitempty"`
+	RTTsMs []int64 `json:"rttsMs"`
+	Error  string  `json:"error,omitempty"`
+}
+
+func (c *client) ping(ctx context.Context, p peer.ID, count int) error {
+	if len(c.host.Network().ConnsToPeer(p)) == 0 {
+		res, err := c.connect(ctx, p)
+		if err != nil {
+			return err
+		}
+		if !res.Success {
+			return fmt.Errorf("cannot connect to %s: %s", p.Pretty(), res.Error)
+		}
+	}
+
+	out := pingJSON{Peer: p.Pretty()}
+	var addrs []ma.Multiaddr
+	for _, conn := range c.host.Network().ConnsToPeer(p) {
+		addrs = append(addrs, conn.RemoteMultiaddr())
+	}
+	if addr := preferDirect(addrs); addr != nil {
+		out.Addr = addr.String()
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "PING %s at %s\n", p.Pretty(), out.Addr)
+
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := ping.Ping(pctx, c.host, p)
+	for len(out.RTTsMs) < count {
+		r, ok := <-results
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			out.Error = r.Error.Error()
+			break
+		}
+		out.RTTsMs = append(out.RTTsMs, int64(r.RTT/time.Millisecond))
+		fmt.Fprintf(&text, "seq=%d time=%s\n", len(out.RTTsMs), r.RTT)
+	}
+	if out.Error != "" {
+		fmt.Fprintf(&text, "error: %s\n", out.Error)
+	}
+	c.print(out, text.String())
+
+	if out.Error != "" {
+		return fmt.Errorf("ping failed")
+	}
+	return nil
+}
+
+// preferDirect returns the first of addrs which is not relayed, or the
+// first one if all are.
+func preferDirect(addrs []ma.Multiaddr) ma.Multiaddr {
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(circuit.P_CIRCUIT); err != nil {
+			return addr
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	return nil
+}
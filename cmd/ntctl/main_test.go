@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+const testPeerID = "QmQnAZsyiJSovuqg8zjP3nKdm6Pwb75Mpn8HnGyD5WYZ15"
+
+func mustAddr(t *testing.T, s string) ma.Multiaddr {
+	t.Helper()
+	addr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestPunchTimeline(t *testing.T) {
+	p, err := peer.IDB58Decode(testPeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct := mustAddr(t, "/ip4/1.2.3.4/tcp/4001")
+	start := time.Now()
+	refused := fmt.Errorf("connection refused")
+
+	trace := []ntraversal.TraceStep{
+		{Name: ntraversal.StepRequestSent, Time: start},
+		{Name: ntraversal.StepDial, Time: start.Add(20 * time.Millisecond), Attempt: 1, Addrs: []ma.Multiaddr{direct}, Err: refused},
+		{Name: ntraversal.StepStrategy, Time: start.Add(50 * time.Millisecond), Strategy: "tcp"},
+	}
+	timeline := []stepJSON{
+		{AtMs: 0, Event: ntraversal.StepRequestSent},
+		{AtMs: 20, Event: ntraversal.StepDial, Attempt: 1, Addrs: []string{direct.String()}, Error: refused.Error()},
+		{AtMs: 50, Event: ntraversal.StepStrategy, Strategy: "tcp"},
+	}
+	res := &ntraversal.PunchResult{
+		Peer:      p,
+		Addr:      direct,
+		Transport: "tcp",
+		Start:     start,
+		Elapsed:   60 * time.Millisecond,
+		Strategy:  "tcp",
+		Trace:     trace,
+	}
+	failed := &ntraversal.PunchResult{Peer: p, Start: start, Elapsed: 60 * time.Millisecond, Trace: trace}
+
+	cases := []struct {
+		name string
+		res  *ntraversal.PunchResult
+		err  error
+		want punchJSON
+		text string
+	}{
+		{"success", res, nil, punchJSON{
+			Peer:      testPeerID,
+			Success:   true,
+			Addr:      direct.String(),
+			Transport: "tcp",
+			Strategy:  "tcp",
+			ElapsedMs: 60,
+			Timeline:  timeline,
+		}, "Connected to " + testPeerID + " at " + direct.String() + " via tcp in 60ms"},
+		{"punch error", nil, &ntraversal.PunchError{Result: failed, Err: ntraversal.ErrConnRefused}, punchJSON{
+			Peer:      testPeerID,
+			ElapsedMs: 60,
+			Error:     ntraversal.ErrConnRefused.Error(),
+			Timeline:  timeline,
+		}, "Failed to connect to " + testPeerID + ": " + ntraversal.ErrConnRefused.Error()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := punchTimeline(p, c.res, c.err)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			(&client{json: true, out: &buf}).printPunch(p, out)
+			var got punchJSON
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("printed\n%+v\nwant\n%+v", got, c.want)
+			}
+
+			buf.Reset()
+			(&client{out: &buf}).printPunch(p, out)
+			if !strings.Contains(buf.String(), "   20ms  dial #1 "+direct.String()+": connection refused\n") {
+				t.Fatalf("text timeline without the dial:\n%s", buf.String())
+			}
+			if !strings.HasSuffix(buf.String(), c.text+"\n") {
+				t.Fatalf("text timeline\n%s\ndoes not end with %q", buf.String(), c.text)
+			}
+		})
+	}
+}
+
+func TestPunchTimelineOtherError(t *testing.T) {
+	p, err := peer.IDB58Decode(testPeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := fmt.Errorf("closed")
+	if _, err := punchTimeline(p, nil, closed); err != closed {
+		t.Fatalf("returned %v, want %v", err, closed)
+	}
+}
+
+func TestPreferDirect(t *testing.T) {
+	const (
+		direct  = "/ip4/1.2.3.4/tcp/4001"
+		relayed = "/ip4/5.6.7.8/tcp/4001/ipfs/" + testPeerID + "/p2p-circuit"
+	)
+
+	cases := []struct {
+		name  string
+		addrs []string
+		want  string
+	}{
+		{"none", nil, ""},
+		{"direct", []string{direct}, direct},
+		{"relayed", []string{relayed}, relayed},
+		{"relayed first", []string{relayed, direct}, direct},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var addrs []ma.Multiaddr
+			for _, s := range c.addrs {
+				addrs = append(addrs, mustAddr(t, s))
+			}
+			got := preferDirect(addrs)
+			if (got == nil && c.want != "") || (got != nil && got.String() != c.want) {
+				t.Fatalf("got %v, want %q", got, c.want)
+			}
+		})
+	}
+}
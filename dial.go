@@ -0,0 +1,147 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// defaultDialStagger is the delay between starting dials to successive
+// candidates, as recommended by RFC 8305.
+const defaultDialStagger = 250 * time.Millisecond
+
+// AddrDialer dials a peer on a single address.
+type AddrDialer interface {
+	DialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) error
+}
+
+type observedKey struct{}
+
+// withObservedAddrs returns a context carrying the addresses a service
+// node observed for the peer being punched to.
+func withObservedAddrs(ctx context.Context, addrs []ma.Multiaddr) context.Context {
+	set := make(map[string]struct{}, len(addrs))
+	for _, a := range addrs {
+		set[string(a.Bytes())] = struct{}{}
+	}
+	return context.WithValue(ctx, observedKey{}, set)
+}
+
+// candidateScore ranks a punch candidate, lower is better. Addresses
+// observed by the service node carry a live NAT mapping, QUIC punches
+// more reliably than TCP and IPv6 rarely needs punching at all.
+func candidateScore(addr ma.Multiaddr, observed map[string]struct{}) int {
+	score := 0
+	if _, ok := observed[string(addr.Bytes())]; ok {
+		score -= 4
+	}
+	if hasProtocol(addr, ma.ProtocolWithName("quic").Code) {
+		score -= 2
+	}
+	if hasProtocol(addr, ma.P_IP6) {
+		score--
+	}
+	return score
+}
+
+// rankCandidates sorts addrs by candidateScore, keeping the order of
+// addresses which score the same.
+func rankCandidates(ctx context.Context, addrs []ma.Multiaddr) []ma.Multiaddr {
+	observed, _ := ctx.Value(observedKey{}).(map[string]struct{})
+
+	ranked := append([]ma.Multiaddr(nil), addrs...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return candidateScore(ranked[i], observed) < candidateScore(ranked[j], observed)
+	})
+	return ranked
+}
+
+// raceDial dials the candidates of pi in ranked order, starting the next
+// one whenever the stagger elapses or a dial fails. The first connection
+// wins and the remaining dials are cancelled.
+func (b *NatTraversal) raceDial(ctx context.Context, pi pstore.PeerInfo, attempt int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	candidates := rankCandidates(ctx, pi.Addrs)
+	if len(candidates) == 0 {
+		return ErrAllAddrsFiltered
+	}
+	results := make(chan error, len(candidates))
+
+	launch := func(addr ma.Multiaddr) {
+		log.Debug("Dialing candidate ", addr, " of ", pi.ID)
+		go func() {
+			start := time.Now()
+			err := b.cfg.dialer.DialAddr(ctx, pi.ID, addr)
+			traceFrom(ctx).add(TraceStep{
+				Name:      StepDial,
+				Time:      start,
+				Duration:  time.Since(start),
+				Attempt:   attempt,
+				Addrs:     []ma.Multiaddr{addr},
+				Transport: transportOf(addr),
+				Err:       err,
+			})
+			results <- err
+		}()
+	}
+
+	next, pending := 0, 0
+	var errs []error
+	stagger := time.NewTimer(0)
+	defer stagger.Stop()
+
+	for next < len(candidates) || pending > 0 {
+		select {
+		case <-stagger.C:
+			if next < len(candidates) {
+				launch(candidates[next])
+				next++
+				pending++
+				stagger.Reset(b.cfg.dialStagger)
+			}
+		case err := <-results:
+			pending--
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+			// Do not wait for the stagger if nothing is in flight.
+			if pending == 0 && next < len(candidates) {
+				if !stagger.Stop() {
+					<-stagger.C
+				}
+				stagger.Reset(0)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return &DialError{
+		Peer:  pi.ID,
+		Class: commonClass(errs),
+		Err:   fmt.Errorf("all %d candidates failed: %v", len(candidates), errs),
+	}
+}
+
+// commonClass returns the class shared by all errs, or nil if they differ.
+func commonClass(errs []error) error {
+	var class error
+	for i, err := range errs {
+		c := classifyDialError(err)
+		if i > 0 && c != class {
+			return nil
+		}
+		class = c
+	}
+	return class
+}
@@ -0,0 +1,116 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// recordingDialer records the addresses dialed and fails every dial
+// except those to connect.
+type recordingDialer struct {
+	connect map[string]bool
+
+	mux    sync.Mutex
+	dialed []string
+	starts []time.Time
+}
+
+func (d *recordingDialer) DialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) error {
+	d.mux.Lock()
+	d.dialed = append(d.dialed, addr.String())
+	d.starts = append(d.starts, time.Now())
+	d.mux.Unlock()
+
+	if d.connect[addr.String()] {
+		return nil
+	}
+	return fmt.Errorf("connection refused")
+}
+
+func TestDialRanksCandidates(t *testing.T) {
+	const (
+		tcp4  = "/ip4/1.2.3.4/tcp/4001"
+		tcp6  = "/ip6/::1/tcp/4001"
+		quic4 = "/ip4/1.2.3.4/udp/4001/quic"
+		obs4  = "/ip4/5.6.7.8/tcp/4001"
+	)
+
+	cases := []struct {
+		name     string
+		addrs    []string
+		observed []string
+		want     []string
+	}{
+		{"single", []string{tcp4}, nil, []string{tcp4}},
+		{"ip6 first", []string{tcp4, tcp6}, nil, []string{tcp6, tcp4}},
+		{"quic first", []string{tcp4, quic4}, nil, []string{quic4, tcp4}},
+		{"observed first", []string{tcp4, quic4, tcp6, obs4}, []string{obs4}, []string{obs4, quic4, tcp6, tcp4}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &recordingDialer{}
+			b := newTestTraversal(t, nil, WithAddrDialer(d), DialStagger(time.Hour))
+
+			ctx := context.Background()
+			if c.observed != nil {
+				ctx = withObservedAddrs(ctx, mustAddrs(t, c.observed))
+			}
+			err := b.Dial(ctx, pstore.PeerInfo{ID: testPeer(t), Addrs: mustAddrs(t, c.addrs)})
+			if err == nil {
+				t.Fatal("dial succeeded")
+			}
+			if fmt.Sprint(d.dialed) != fmt.Sprint(c.want) {
+				t.Fatalf("dialed %v, want %v", d.dialed, c.want)
+			}
+		})
+	}
+}
+
+func TestDialStagger(t *testing.T) {
+	const stagger = 50 * time.Millisecond
+
+	addrs := []string{"/ip4/1.2.3.4/tcp/4001", "/ip4/1.2.3.4/tcp/4002"}
+	d := &blockingDialer{recordingDialer{connect: map[string]bool{addrs[1]: true}}}
+	b := newTestTraversal(t, nil, WithAddrDialer(d), DialStagger(stagger))
+
+	if err := b.Dial(context.Background(), pstore.PeerInfo{ID: testPeer(t), Addrs: mustAddrs(t, addrs)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.starts) != 2 {
+		t.Fatalf("%d dials, want 2", len(d.starts))
+	}
+	if gap := d.starts[1].Sub(d.starts[0]); gap < stagger {
+		t.Fatalf("second dial started after %s, want at least %s", gap, stagger)
+	}
+}
+
+// blockingDialer dials like recordingDialer but blocks failing dials until
+// they are cancelled.
+type blockingDialer struct {
+	recordingDialer
+}
+
+func (d *blockingDialer) DialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) error {
+	if err := d.recordingDialer.DialAddr(ctx, p, addr); err != nil {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func mustAddrs(t *testing.T, ss []string) []ma.Multiaddr {
+	t.Helper()
+
+	addrs := make([]ma.Multiaddr, 0, len(ss))
+	for _, s := range ss {
+		addrs = append(addrs, mustAddr(t, s))
+	}
+	return addrs
+}
@@ -0,0 +1,123 @@
+package ntraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Classes of dial failures. Errors returned by punches match one of them
+// with errors.Is when the cause of the failure is known.
+var (
+	ErrDialTimeout      = fmt.Errorf("dial timed out")
+	ErrConnRefused      = fmt.Errorf("connection refused")
+	ErrNoRoute          = fmt.Errorf("no route to host")
+	ErrConnReset        = fmt.Errorf("connection reset")
+	ErrPeerIDMismatch   = fmt.Errorf("peer id mismatch")
+	ErrDialBackoff      = fmt.Errorf("dial backoff")
+	ErrAllAddrsFiltered = fmt.Errorf("all addresses filtered")
+)
+
+var dialErrorClasses = []error{
+	ErrDialTimeout,
+	ErrConnRefused,
+	ErrNoRoute,
+	ErrConnReset,
+	ErrPeerIDMismatch,
+	ErrDialBackoff,
+	ErrAllAddrsFiltered,
+}
+
+// DialError is a failed dial to a peer. It matches its class with
+// errors.Is and unwraps to the error of the dialer.
+type DialError struct {
+	Peer peer.ID
+	// Addr is the address dialed, nil if several were dialed at once.
+	Addr ma.Multiaddr
+	// Class is one of the Err* dial failure classes, or nil if unknown.
+	Class error
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	if e.Addr != nil {
+		return fmt.Sprintf("dial to %s at %s: %s", e.Peer.Pretty(), e.Addr, e.Err)
+	}
+	return fmt.Sprintf("dial to %s: %s", e.Peer.Pretty(), e.Err)
+}
+
+// Unwrap returns the error of the dialer.
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the class of e.
+func (e *DialError) Is(target error) bool {
+	return e.Class != nil && target == e.Class
+}
+
+func newDialError(p peer.ID, addr ma.Multiaddr, err error) *DialError {
+	if de, ok := err.(*DialError); ok {
+		return de
+	}
+	return &DialError{Peer: p, Addr: addr, Class: classifyDialError(err), Err: err}
+}
+
+// dialErrorFragments classify errors which only carry the text of their
+// cause, as the swarm and the transports flatten the errors of dials.
+var dialErrorFragments = []struct {
+	fragment string
+	class    error
+}{
+	{"i/o timeout", ErrDialTimeout},
+	{"connection refused", ErrConnRefused},
+	{"no route to host", ErrNoRoute},
+	{"network is unreachable", ErrNoRoute},
+	{"connection reset", ErrConnReset},
+	{"peer id mismatch", ErrPeerIDMismatch},
+	{"connected to wrong peer", ErrPeerIDMismatch},
+	{"dial backoff", ErrDialBackoff},
+	{"no good addresses", ErrAllAddrsFiltered},
+	{"no addresses", ErrAllAddrsFiltered},
+}
+
+// classifyDialError returns the class of a dial failure, or nil if it is
+// not known.
+func classifyDialError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, class := range dialErrorClasses {
+		if errors.Is(err, class) {
+			return class
+		}
+	}
+
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrDialTimeout
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return ErrDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ErrNoRoute
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrConnReset
+	}
+
+	msg := err.Error()
+	for _, f := range dialErrorFragments {
+		if strings.Contains(msg, f.fragment) {
+			return f.class
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package ntraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyDialError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"unknown", fmt.Errorf("something else"), nil},
+		{"class", ErrConnReset, ErrConnReset},
+		{"wrapped class", fmt.Errorf("dial: %w", ErrPeerIDMismatch), ErrPeerIDMismatch},
+		{"deadline", context.DeadlineExceeded, ErrDialTimeout},
+		{"wrapped deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), ErrDialTimeout},
+		{"net timeout", timeoutError{}, ErrDialTimeout},
+		{"refused", os.NewSyscallError("connect", syscall.ECONNREFUSED), ErrConnRefused},
+		{"host unreachable", os.NewSyscallError("connect", syscall.EHOSTUNREACH), ErrNoRoute},
+		{"net unreachable", os.NewSyscallError("connect", syscall.ENETUNREACH), ErrNoRoute},
+		{"reset", os.NewSyscallError("read", syscall.ECONNRESET), ErrConnReset},
+		{"text timeout", fmt.Errorf("dial tcp 1.2.3.4:4001: i/o timeout"), ErrDialTimeout},
+		{"text refused", fmt.Errorf("dial tcp 1.2.3.4:4001: connection refused"), ErrConnRefused},
+		{"text no route", fmt.Errorf("connect: no route to host"), ErrNoRoute},
+		{"text unreachable", fmt.Errorf("connect: network is unreachable"), ErrNoRoute},
+		{"text reset", fmt.Errorf("read: connection reset by peer"), ErrConnReset},
+		{"text mismatch", fmt.Errorf("peer id mismatch: expected a, but remote key matches b"), ErrPeerIDMismatch},
+		{"text wrong peer", fmt.Errorf("connected to wrong peer"), ErrPeerIDMismatch},
+		{"text backoff", fmt.Errorf("dial backoff"), ErrDialBackoff},
+		{"text no good addresses", fmt.Errorf("no good addresses"), ErrAllAddrsFiltered},
+		{"text no addresses", fmt.Errorf("no addresses"), ErrAllAddrsFiltered},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyDialError(c.err); got != c.want {
+				t.Fatalf("class %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDialError(t *testing.T) {
+	p := testPeer(t)
+	addr := mustAddr(t, "/ip4/1.2.3.4/tcp/4001")
+	cause := fmt.Errorf("dial tcp 1.2.3.4:4001: connection refused")
+
+	cases := []struct {
+		name    string
+		err     *DialError
+		msg     string
+		class   error
+		unknown bool
+	}{
+		{
+			name:  "with addr",
+			err:   newDialError(p, addr, cause),
+			msg:   fmt.Sprintf("dial to %s at %s: %s", p.Pretty(), addr, cause),
+			class: ErrConnRefused,
+		},
+		{
+			name:  "without addr",
+			err:   newDialError(p, nil, cause),
+			msg:   fmt.Sprintf("dial to %s: %s", p.Pretty(), cause),
+			class: ErrConnRefused,
+		},
+		{
+			name:    "unknown class",
+			err:     newDialError(p, nil, fmt.Errorf("something else")),
+			msg:     fmt.Sprintf("dial to %s: something else", p.Pretty()),
+			unknown: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if msg := c.err.Error(); msg != c.msg {
+				t.Fatalf("message %q, want %q", msg, c.msg)
+			}
+			if c.unknown {
+				if c.err.Class != nil {
+					t.Fatalf("class %v, want none", c.err.Class)
+				}
+				for _, class := range dialErrorClasses {
+					if errors.Is(c.err, class) {
+						t.Fatalf("matches %v", class)
+					}
+				}
+			} else {
+				if !errors.Is(c.err, c.class) {
+					t.Fatalf("does not match %v", c.class)
+				}
+				if errors.Is(c.err, ErrDialTimeout) {
+					t.Fatal("matches another class")
+				}
+			}
+
+			var wrapped error = fmt.Errorf("punch: %w", c.err)
+			var de *DialError
+			if !errors.As(wrapped, &de) || de != c.err {
+				t.Fatal("not found in wrapping error")
+			}
+			if errors.Unwrap(c.err) != c.err.Err {
+				t.Fatal("does not unwrap to the error of the dialer")
+			}
+		})
+	}
+}
+
+func TestNewDialErrorKeepsDialError(t *testing.T) {
+	de := newDialError(testPeer(t), nil, ErrNoRoute)
+	if got := newDialError(testPeer(t), nil, de); got != de {
+		t.Fatalf("got %v, want the dial error passed", got)
+	}
+}
+
+func TestCommonClass(t *testing.T) {
+	refused := fmt.Errorf("connection refused")
+
+	cases := []struct {
+		name string
+		errs []error
+		want error
+	}{
+		{"none", nil, nil},
+		{"single", []error{refused}, ErrConnRefused},
+		{"same", []error{refused, ErrConnRefused}, ErrConnRefused},
+		{"different", []error{refused, ErrNoRoute}, nil},
+		{"unknown", []error{refused, fmt.Errorf("something else")}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := commonClass(c.errs); got != c.want {
+				t.Fatalf("class %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package ntraversal
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// EventType identifies a traversal lifecycle event.
+type EventType int
+
+const (
+	// EvtServiceNodeConnected is emitted when a stream to a service node is established.
+	EvtServiceNodeConnected EventType = iota
+	// EvtServiceNodeDisconnected is emitted when the stream to a service node is lost.
+	EvtServiceNodeDisconnected
+	// EvtPunchRequested is emitted when a connection request is sent to a service node.
+	EvtPunchRequested
+	// EvtPunchInstructionReceived is emitted when a service node asks us to punch.
+	EvtPunchInstructionReceived
+	// EvtDialAttemptStarted is emitted before every dial to the remote peer.
+	EvtDialAttemptStarted
+	// EvtDialAttemptFailed is emitted when a dial to the remote peer fails.
+	EvtDialAttemptFailed
+	// EvtDirectConnEstablished is emitted when a direct connection is established.
+	EvtDirectConnEstablished
+	// EvtRelayFallback is emitted when a relayed connection is used instead of a direct one.
+	EvtRelayFallback
+	// EvtNATTypeChanged is emitted when the detected NAT type of this node changes.
+	EvtNATTypeChanged
+)
+
+var eventTypeNames = map[EventType]string{
+	EvtServiceNodeConnected:     "ServiceNodeConnected",
+	EvtServiceNodeDisconnected:  "ServiceNodeDisconnected",
+	EvtPunchRequested:           "PunchRequested",
+	EvtPunchInstructionReceived: "PunchInstructionReceived",
+	EvtDialAttemptStarted:       "DialAttemptStarted",
+	EvtDialAttemptFailed:        "DialAttemptFailed",
+	EvtDirectConnEstablished:    "DirectConnEstablished",
+	EvtRelayFallback:            "RelayFallback",
+	EvtNATTypeChanged:           "NATTypeChanged",
+}
+
+func (t EventType) String() string {
+	if n, ok := eventTypeNames[t]; ok {
+		return n
+	}
+	return "Unknown"
+}
+
+// NATType describes the mapping behaviour of the NAT this node is behind.
+type NATType int
+
+const (
+	NATUnknown NATType = iota
+	NATNone
+	NATFullCone
+	NATRestrictedCone
+	NATPortRestrictedCone
+	NATSymmetric
+)
+
+var natTypeNames = map[NATType]string{
+	NATUnknown:            "Unknown",
+	NATNone:               "None",
+	NATFullCone:           "FullCone",
+	NATRestrictedCone:     "RestrictedCone",
+	NATPortRestrictedCone: "PortRestrictedCone",
+	NATSymmetric:          "Symmetric",
+}
+
+func (t NATType) String() string {
+	if n, ok := natTypeNames[t]; ok {
+		return n
+	}
+	return "Unknown"
+}
+
+// parseNATType returns the NAT type named s, or NATUnknown if s names none.
+func parseNATType(s string) NATType {
+	for t, n := range natTypeNames {
+		if n == s {
+			return t
+		}
+	}
+	return NATUnknown
+}
+
+// Event is a traversal lifecycle event. Fields which do not apply to the
+// event type are left as zero values.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Peer is the service node or remote peer the event is about.
+	Peer peer.ID
+	// Attempt is the 1-based dial attempt for dial events.
+	Attempt int
+	Addrs   []ma.Multiaddr
+	Err     error
+	NATType NATType
+	// Strategy is the traversal strategy which established a connection.
+	Strategy string
+}
+
+// eventBufSize is the per subscriber buffer. Events are dropped for
+// subscribers which fall behind rather than blocking traversal.
+const eventBufSize = 32
+
+type eventBus struct {
+	mux  sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+func (eb *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufSize)
+
+	eb.mux.Lock()
+	eb.subs[ch] = struct{}{}
+	eb.mux.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			eb.mux.Lock()
+			delete(eb.subs, ch)
+			eb.mux.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+func (eb *eventBus) emit(evt Event) {
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+
+	for ch := range eb.subs {
+		select {
+		case ch <- evt:
+		default:
+			log.Warning("dropping event for slow subscriber: ", evt.Type)
+		}
+	}
+}
+
+// Subscribe returns a channel of traversal lifecycle events and a function
+// to cancel the subscription, which closes the channel. Slow subscribers
+// miss events instead of stalling traversal.
+func (b *NatTraversal) Subscribe() (<-chan Event, func()) {
+	return b.events.subscribe()
+}
@@ -0,0 +1,70 @@
+package ntraversal
+
+import (
+	"testing"
+)
+
+func TestEventTypeString(t *testing.T) {
+	cases := []struct {
+		t    EventType
+		want string
+	}{
+		{EvtServiceNodeConnected, "ServiceNodeConnected"},
+		{EvtRelayFallback, "RelayFallback"},
+		{EvtNATTypeChanged, "NATTypeChanged"},
+		{EventType(100), "Unknown"},
+	}
+	for _, c := range cases {
+		if got := c.t.String(); got != c.want {
+			t.Errorf("%d: got %q, want %q", c.t, got, c.want)
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	eb := newEventBus()
+	ch, cancel := eb.subscribe()
+
+	eb.emit(Event{Type: EvtPunchRequested})
+	evt := <-ch
+	if evt.Type != EvtPunchRequested || evt.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	// a slow subscriber loses events instead of blocking emit
+	for i := 0; i < eventBufSize+5; i++ {
+		eb.emit(Event{Type: EvtDialAttemptStarted})
+	}
+	if len(ch) != eventBufSize {
+		t.Fatalf("buffered %d events, want %d", len(ch), eventBufSize)
+	}
+
+	cancel()
+	cancel()
+	for range ch {
+	}
+	eb.emit(Event{Type: EvtPunchRequested})
+}
+
+func TestSetNATType(t *testing.T) {
+	b := &NatTraversal{events: newEventBus()}
+	ch, cancel := b.Subscribe()
+	defer cancel()
+
+	b.setNATType(NATSymmetric)
+	b.setNATType(NATSymmetric)
+	b.setNATType(NATFullCone)
+
+	for _, want := range []NATType{NATSymmetric, NATFullCone} {
+		evt := <-ch
+		if evt.Type != EvtNATTypeChanged || evt.NATType != want {
+			t.Fatalf("got %s %s, want NATTypeChanged %s", evt.Type, evt.NATType, want)
+		}
+	}
+	if len(ch) != 0 {
+		t.Fatalf("unchanged NAT type was emitted")
+	}
+	if b.NATType() != NATFullCone {
+		t.Fatalf("NATType() = %s", b.NATType())
+	}
+}
@@ -30,9 +30,12 @@ func main() {
 		panic(err)
 	}
 
-	b, _ := ntraversal.NewNatTraversal(ctx, &host, d)
+	b, _ := ntraversal.NewNatTraversal(ctx, host, d)
 	b.ConnectToServiceNodes(ctx, []string{"/ip4/127.0.0.1/tcp/3001/p2p/Qmc5mVjNN6n8DG4ky2wxQTY3tWks4Wufgqhz9PbevadKBW"})
 
+	// Dials through the wrapped host fall back to hole punching.
+	th := ntraversal.WrapHost(host, b)
+
 	v1b := cid.V1Builder{Codec: cid.Raw, MhType: mh.SHA2_256}
 	rendezvousPoint, _ := v1b.Sum([]byte("hey"))
 	err = d.Provide(ctx, rendezvousPoint, true)
@@ -46,16 +49,8 @@ func main() {
 	}
 
 	for _, pi := range pis {
-		if err := host.Connect(ctx, pi); err != nil {
-			cerr, err := b.ConnectThroughHolePunching(ctx, pi.ID)
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				err = <-cerr
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
+		if err := th.Connect(ctx, pi); err != nil {
+			fmt.Println(err)
 		}
 	}
 
@@ -10,9 +10,9 @@ import (
 	logging "github.com/ipfs/go-log"
 	libp2p "github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	mplex "github.com/libp2p/go-libp2p-mplex"
 	peer "github.com/libp2p/go-libp2p-peer"
 	ma "github.com/multiformats/go-multiaddr"
-	mplex "github.com/whyrusleeping/go-smux-multiplex"
 
 	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
 )
@@ -55,6 +55,7 @@ func main() {
 		ctx,
 		libp2p.ListenAddrs(sourceMultiAddr),
 		libp2p.Muxer("/mplex/6.7.0", mplex.DefaultTransport),
+		ntraversal.PunchTransport,
 	)
 	if err != nil {
 		panic(err)
@@ -67,7 +68,7 @@ func main() {
 		panic(err)
 	}
 
-	b, _ := ntraversal.NewNatTraversal(ctx, &host, d)
+	b, _ := ntraversal.NewNatTraversal(ctx, host, d)
 
 	/* ma, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/3000/p2p/QmSHQpWVzoGWiYRyBrikFp6tr8MAwm6RnUxPsu1NC2y8iJ")
 	pi, _ := pstore.InfoFromP2pAddr(ma) */
@@ -0,0 +1,118 @@
+module github.com/upperwal/go-libp2p-nat-traversal
+
+go 1.26.0
+
+require (
+	github.com/gogo/protobuf v1.2.1
+	github.com/golang/protobuf v1.3.1
+	github.com/ipfs/go-cid v0.0.2
+	github.com/ipfs/go-ipfs-addr v0.0.1
+	github.com/ipfs/go-log v0.0.1
+	github.com/libp2p/go-libp2p v0.0.30
+	github.com/libp2p/go-libp2p-circuit v0.0.9
+	github.com/libp2p/go-libp2p-crypto v0.0.2
+	github.com/libp2p/go-libp2p-host v0.0.3
+	github.com/libp2p/go-libp2p-kad-dht v0.0.15
+	github.com/libp2p/go-libp2p-mplex v0.1.1
+	github.com/libp2p/go-libp2p-net v0.0.2
+	github.com/libp2p/go-libp2p-peer v0.1.1
+	github.com/libp2p/go-libp2p-peerstore v0.0.6
+	github.com/libp2p/go-libp2p-protocol v0.0.1
+	github.com/libp2p/go-libp2p-swarm v0.0.6
+	github.com/libp2p/go-libp2p-transport v0.0.5
+	github.com/libp2p/go-libp2p-transport-upgrader v0.0.4
+	github.com/libp2p/go-nat v0.0.3
+	github.com/libp2p/go-tcp-transport v0.0.4
+	github.com/libp2p/go-ws-transport v0.0.5
+	github.com/multiformats/go-multiaddr v0.0.4
+	github.com/multiformats/go-multihash v0.0.5
+	github.com/prometheus/client_golang v0.9.3
+	go.opentelemetry.io/otel v1.47.0
+	go.opentelemetry.io/otel/sdk v1.47.0
+	go.opentelemetry.io/otel/trace v1.47.0
+	golang.org/x/time v0.16.0
+	gopkg.in/yaml.v2 v2.2.2
+)
+
+require (
+	github.com/beorn7/perks v1.0.0 // indirect
+	github.com/btcsuite/btcd v0.0.0-20190213025234-306aecffea32 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/coreos/go-semver v0.2.1-0.20180108230905-e214231b295a // indirect
+	github.com/go-logr/logr v1.4.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/hashicorp/golang-lru v0.5.1 // indirect
+	github.com/huin/goupnp v1.0.0 // indirect
+	github.com/ipfs/go-datastore v0.0.5 // indirect
+	github.com/ipfs/go-ipfs-util v0.0.1 // indirect
+	github.com/ipfs/go-todocounter v0.0.1 // indirect
+	github.com/jackpal/gateway v1.0.5 // indirect
+	github.com/jackpal/go-nat-pmp v1.0.1 // indirect
+	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
+	github.com/jbenet/go-temp-err-catcher v0.0.0-20150120210811-aac704a3f4f2 // indirect
+	github.com/jbenet/goprocess v0.1.3 // indirect
+	github.com/koron/go-ssdp v0.0.0-20180514024734-4a0ed625a78b // indirect
+	github.com/libp2p/go-addr-util v0.0.1 // indirect
+	github.com/libp2p/go-buffer-pool v0.0.2 // indirect
+	github.com/libp2p/go-conn-security v0.0.1 // indirect
+	github.com/libp2p/go-conn-security-multistream v0.0.2 // indirect
+	github.com/libp2p/go-flow-metrics v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-autonat v0.0.6 // indirect
+	github.com/libp2p/go-libp2p-discovery v0.0.5 // indirect
+	github.com/libp2p/go-libp2p-interface-connmgr v0.0.5 // indirect
+	github.com/libp2p/go-libp2p-interface-pnet v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-kbucket v0.1.1 // indirect
+	github.com/libp2p/go-libp2p-loggables v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-metrics v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-nat v0.0.4 // indirect
+	github.com/libp2p/go-libp2p-netutil v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-record v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-routing v0.0.1 // indirect
+	github.com/libp2p/go-libp2p-secio v0.0.3 // indirect
+	github.com/libp2p/go-libp2p-yamux v0.1.3 // indirect
+	github.com/libp2p/go-maddr-filter v0.0.4 // indirect
+	github.com/libp2p/go-mplex v0.0.4 // indirect
+	github.com/libp2p/go-msgio v0.0.2 // indirect
+	github.com/libp2p/go-reuseport v0.0.1 // indirect
+	github.com/libp2p/go-reuseport-transport v0.0.2 // indirect
+	github.com/libp2p/go-stream-muxer v0.0.1 // indirect
+	github.com/libp2p/go-stream-muxer-multistream v0.1.1 // indirect
+	github.com/libp2p/go-testutil v0.0.1 // indirect
+	github.com/libp2p/go-yamux v1.2.3 // indirect
+	github.com/mattn/go-colorable v0.1.2 // indirect
+	github.com/mattn/go-isatty v0.0.8 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1 // indirect
+	github.com/minio/sha256-simd v0.0.0-20190328051042-05b4dd3047e5 // indirect
+	github.com/mr-tron/base58 v1.1.2 // indirect
+	github.com/multiformats/go-base32 v0.0.3 // indirect
+	github.com/multiformats/go-multiaddr-dns v0.0.2 // indirect
+	github.com/multiformats/go-multiaddr-net v0.0.1 // indirect
+	github.com/multiformats/go-multibase v0.0.1 // indirect
+	github.com/multiformats/go-multistream v0.0.4 // indirect
+	github.com/opentracing/opentracing-go v1.0.2 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90 // indirect
+	github.com/prometheus/common v0.4.0 // indirect
+	github.com/prometheus/procfs v0.0.0-20190507164030-5867b95ac084 // indirect
+	github.com/spacemonkeygo/openssl v0.0.0-20181017203307-c2dcc5cca94a // indirect
+	github.com/spacemonkeygo/spacelog v0.0.0-20180420211403-2296661a0572 // indirect
+	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	github.com/whyrusleeping/base32 v0.0.0-20170828182744-c30ac30633cc // indirect
+	github.com/whyrusleeping/go-keyspace v0.0.0-20160322163242-5b898ac5add1 // indirect
+	github.com/whyrusleeping/go-logging v0.0.0-20170515211332-0457bb6b88fc // indirect
+	github.com/whyrusleeping/go-notifier v0.0.0-20170827234753-097c5d47330f // indirect
+	github.com/whyrusleeping/mafmt v1.2.8 // indirect
+	github.com/whyrusleeping/multiaddr-filter v0.0.0-20160516205228-e903e4adabd7 // indirect
+	go.opencensus.io v0.21.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.2.1 // indirect
+	go.opentelemetry.io/otel/log v1.47.0 // indirect
+	go.opentelemetry.io/otel/metric v1.47.0 // indirect
+	golang.org/x/crypto v0.0.0-20190426145343-a29dc8fdc734 // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/xerrors v0.0.0-20240903120638-7835f813f4da // indirect
+)
@@ -0,0 +1,155 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether the in-flight
+// handlers finished.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// ErrClosed is returned once the NatTraversal is shutting down or closed.
+var ErrClosed = fmt.Errorf("nat traversal closed")
+
+// Ready returns nil while the node can take new requests: it is not
+// shutting down, its stream handler is registered and its message queues
+// are not full.
+func (b *NatTraversal) Ready() error {
+	b.closeMux.Lock()
+	closing := b.closing
+	b.closeMux.Unlock()
+	if closing {
+		return ErrClosed
+	}
+
+	registered := false
+	for _, p := range b.host.Mux().Protocols() {
+		if p == protocolBootstrap {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return fmt.Errorf("stream handler for %s not registered", protocolBootstrap)
+	}
+
+	if len(b.incoming) == cap(b.incoming) {
+		return fmt.Errorf("incoming queue full")
+	}
+	if len(b.outgoing) == cap(b.outgoing) {
+		return fmt.Errorf("outgoing queue full")
+	}
+	return nil
+}
+
+// Shutdown stops taking new traversal streams and connection requests,
+// waits for the requests in flight to be handled and then closes b. If
+// ctx is done first, b is closed anyway and the context's error returned.
+func (b *NatTraversal) Shutdown(ctx context.Context) error {
+	b.closeMux.Lock()
+	b.closing = true
+	b.closeMux.Unlock()
+
+	b.host.RemoveStreamHandler(protocolBootstrap)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var err error
+	for b.inflightCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close stops b immediately. Traversal streams are reset, running
+// strategies are cancelled, pending punches fail with ErrClosed and mapped
+// ports are removed.
+func (b *NatTraversal) Close() error {
+	b.closeMux.Lock()
+	if b.closed {
+		b.closeMux.Unlock()
+		return nil
+	}
+	b.closing = true
+	b.closed = true
+	b.closeMux.Unlock()
+
+	b.cancel()
+
+	b.host.RemoveStreamHandler(protocolBootstrap)
+	if b.cfg.upgradeRelayed {
+		b.host.RemoveStreamHandler(protocolUpgrade)
+		b.host.Network().StopNotify(b.relayWatcher)
+	}
+
+	b.bootstrapPeers.mux.Lock()
+	for _, sm := range b.bootstrapPeers.peerList {
+		(*sm.s).Reset()
+	}
+	b.bootstrapPeers.mux.Unlock()
+
+	b.connMux.Lock()
+	pending := make([]peer.ID, 0, len(b.connMap))
+	for p := range b.connMap {
+		pending = append(pending, p)
+	}
+	b.connMux.Unlock()
+
+	for _, p := range pending {
+		b.resolvePending(p, ErrClosed)
+	}
+
+	if b.portMapDone != nil {
+		<-b.portMapDone
+	}
+	return nil
+}
+
+func (b *NatTraversal) isClosing() bool {
+	b.closeMux.Lock()
+	defer b.closeMux.Unlock()
+	return b.closing
+}
+
+func (b *NatTraversal) inflightCount() int {
+	b.closeMux.Lock()
+	defer b.closeMux.Unlock()
+	return b.inflight
+}
+
+// track runs a packet handler in its own goroutine and counts it as in
+// flight until it returns, so Shutdown can wait for it.
+func (b *NatTraversal) track(handler func(PacketWPeer), m PacketWPeer) {
+	b.closeMux.Lock()
+	if b.closed {
+		b.closeMux.Unlock()
+		return
+	}
+	b.inflight++
+	b.closeMux.Unlock()
+
+	go func() {
+		defer func() {
+			b.closeMux.Lock()
+			b.inflight--
+			b.closeMux.Unlock()
+		}()
+		handler(m)
+	}()
+}
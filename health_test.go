@@ -0,0 +1,132 @@
+package ntraversal
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	ggio "github.com/gogo/protobuf/io"
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+// notifyHost records the notifiees registered with its network.
+type notifyHost struct {
+	host.Host
+	net *notifyNetwork
+}
+
+func (h notifyHost) Network() inet.Network { return h.net }
+
+type notifyNetwork struct {
+	inet.Network
+	notifiees map[inet.Notifiee]bool
+}
+
+func (n *notifyNetwork) Notify(f inet.Notifiee) {
+	n.notifiees[f] = true
+	n.Network.Notify(f)
+}
+
+func (n *notifyNetwork) StopNotify(f inet.Notifiee) {
+	delete(n.notifiees, f)
+	n.Network.StopNotify(f)
+}
+
+func TestCloseStopsRelayWatcher(t *testing.T) {
+	h, err := mocknet.New(context.Background()).GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	nh := notifyHost{h, &notifyNetwork{h.Network(), make(map[inet.Notifiee]bool)}}
+
+	b, err := NewNatTraversal(context.Background(), nh, nil, UpgradeRelayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nh.net.notifiees) != 1 {
+		t.Fatalf("%d notifiees, want the relay watcher", len(nh.net.notifiees))
+	}
+	b.Close()
+	if len(nh.net.notifiees) != 0 {
+		t.Fatal("relay watcher still notified after Close")
+	}
+}
+
+// blockingStrategy signals started and runs until its context is done.
+type blockingStrategy struct {
+	started chan struct{}
+}
+
+func (s blockingStrategy) Name() string { return "blocking" }
+
+func (s blockingStrategy) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	close(s.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCloseCancelsPipeline(t *testing.T) {
+	st := blockingStrategy{started: make(chan struct{})}
+	b := newTestTraversal(t, nil, Pipeline(Stage{Strategy: st, Timeout: time.Hour}))
+
+	sn := testPeer(t)
+	b.serviceNodes = []peer.ID{sn}
+
+	info, err := pstore.PeerInfo{ID: testPeer(t)}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		b.handleHolePunchRequest(PacketWPeer{
+			peer: sn,
+			packet: &protocol.Protocol{
+				Type:     protocol.Protocol_HOLE_PUNCH_REQUEST,
+				PeerInfo: &protocol.Protocol_PeerInfo{Info: info},
+			},
+		})
+		close(done)
+	}()
+
+	<-st.started
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("strategy still running after Close")
+	}
+}
+
+func TestReadMsgStopsOnClose(t *testing.T) {
+	var buf bytes.Buffer
+	w := ggio.NewDelimitedWriter(&buf)
+	for i := 0; i < 2; i++ {
+		w.WriteMsg(&protocol.Protocol{Type: protocol.Protocol_PUNCH_RESULT, PunchResult: &protocol.Protocol_PunchResult{}})
+	}
+
+	var s inet.Stream = fakeStream{remote: "remote"}
+	r := ggio.NewDelimitedReader(&buf, 1<<12)
+	sw := &streamWrapper{s: &s, r: &r}
+
+	// Nobody reads incoming, as after Close.
+	closed := make(chan struct{})
+	close(closed)
+	done := make(chan error)
+	go func() { done <- sw.readMsg(make(chan PacketWPeer), closed) }()
+
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Fatalf("got %v, want %v", err, ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readMsg blocked on a closed traversal")
+	}
+}
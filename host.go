@@ -0,0 +1,57 @@
+package ntraversal
+
+import (
+	"context"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+	transport "github.com/libp2p/go-libp2p-transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	ws "github.com/libp2p/go-ws-transport"
+)
+
+// Libp2p returns a libp2p option enabling NAT traversal on the host being
+// built, so traversal is set up with the other host options:
+//
+//	var nt *ntraversal.NatTraversal
+//	h, err := libp2p.New(ctx,
+//		libp2p.ListenAddrs(addr),
+//		ntraversal.Libp2p(&nt, nil),
+//	)
+//
+// It installs the PunchTransport and starts traversal on the host once
+// the transports are built, storing it in *nt, which is only valid if
+// libp2p.New succeeds. Traversal is closed with the host. Like any
+// transport option it replaces the default transports and listen
+// addresses of libp2p, so ListenAddrs must be given.
+//
+// If router is nil, a service node resolves peers from the host's
+// peerstore. Routers needing the host, like a DHT, cannot be built before
+// it; use PunchTransport and NewNatTraversal for them instead.
+func Libp2p(nt **NatTraversal, router PeerRouter, opts ...Option) libp2p.Option {
+	return libp2p.ChainOptions(
+		libp2p.Transport(func(h host.Host, u *tptu.Upgrader) (transport.Transport, error) {
+			cfg := defaultConfig()
+			if err := cfg.apply(opts...); err != nil {
+				return nil, err
+			}
+			r := router
+			if r == nil && cfg.serviceNode {
+				r = NewPeerstoreRouter(h)
+			}
+
+			b, err := NewNatTraversal(context.Background(), h, r, opts...)
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				<-h.Network().Process().Closing()
+				b.Close()
+			}()
+			*nt = b
+
+			return newTCPPunchTransport(u), nil
+		}),
+		libp2p.Transport(ws.New),
+	)
+}
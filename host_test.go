@@ -0,0 +1,56 @@
+package ntraversal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+)
+
+func TestLibp2p(t *testing.T) {
+	sk, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nt *NatTraversal
+	h, err := libp2p.New(context.Background(),
+		libp2p.Identity(sk),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		Libp2p(&nt, nil, BootstrapServer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nt == nil {
+		t.Fatal("traversal not started")
+	}
+	if nt.router == nil {
+		t.Fatal("service node without a router")
+	}
+	if punchTransportFor(h.Network(), h.Addrs()[0]) == nil {
+		t.Fatal("host without a punch transport")
+	}
+
+	h.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !nt.isClosing() {
+		if time.Now().After(deadline) {
+			t.Fatal("traversal not closed with the host")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLibp2pInvalidOption(t *testing.T) {
+	var nt *NatTraversal
+	_, err := libp2p.New(context.Background(),
+		libp2p.NoListenAddrs,
+		Libp2p(&nt, nil, MaxMessageSize(0)),
+	)
+	if err == nil {
+		t.Fatal("host built with an invalid traversal option")
+	}
+}
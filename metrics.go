@@ -0,0 +1,169 @@
+package ntraversal
+
+import (
+	"errors"
+
+	ma "github.com/multiformats/go-multiaddr"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "ntraversal"
+
+type metrics struct {
+	connRequests      prometheus.Counter
+	dhtLookups        *prometheus.CounterVec
+	dhtLookupDuration prometheus.Histogram
+	punchInstructions prometheus.Counter
+	punchAttempts     prometheus.Counter
+	punchResults      *prometheus.CounterVec
+	timeToConnect     prometheus.Histogram
+	registeredClients prometheus.Gauge
+	punchReports      *prometheus.CounterVec
+	queueDepth        []prometheus.Collector
+}
+
+func newMetrics(b *NatTraversal) *metrics {
+	m := &metrics{
+		connRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connection_requests_received_total",
+			Help:      "Connection requests received by this service node.",
+		}),
+		dhtLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dht_lookups_total",
+			Help:      "Peer lookups done while coordinating a punch, by result.",
+		}, []string{"result"}),
+		dhtLookupDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "dht_lookup_duration_seconds",
+			Help:      "Latency of peer lookups done while coordinating a punch.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		punchInstructions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "punch_instructions_sent_total",
+			Help:      "Hole punch requests sent to clients by this service node.",
+		}),
+		punchAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "punch_attempts_total",
+			Help:      "Dial attempts made while punching.",
+		}),
+		punchResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "punch_results_total",
+			Help:      "Outcome of hole punches, by result, failure reason and transport.",
+		}, []string{"result", "reason", "transport"}),
+		timeToConnect: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_connect_seconds",
+			Help:      "Time from receiving a punch request to an established connection.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		registeredClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "registered_clients",
+			Help:      "Peers with an open traversal protocol stream.",
+		}),
+		punchReports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "punch_reports_total",
+			Help:      "Punch results reported by clients, by result, NAT type and address family.",
+		}, []string{"result", "nat_type", "family"}),
+	}
+
+	queues := map[string]chan PacketWPeer{
+		"incoming": b.incoming,
+		"outgoing": b.outgoing,
+	}
+	for name, q := range queues {
+		q := q
+		m.queueDepth = append(m.queueDepth, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "queue_depth",
+			Help:        "Packets waiting in the message handler queues.",
+			ConstLabels: prometheus.Labels{"queue": name},
+		}, func() float64 {
+			return float64(len(q))
+		}))
+	}
+
+	return m
+}
+
+func (m *metrics) register(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		m.connRequests,
+		m.dhtLookups,
+		m.dhtLookupDuration,
+		m.punchInstructions,
+		m.punchAttempts,
+		m.punchResults,
+		m.timeToConnect,
+		m.registeredClients,
+		m.punchReports,
+	}
+	collectors = append(collectors, m.queueDepth...)
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transportOf returns the transport protocol used by a multiaddr, as used
+// for the transport metrics label.
+func transportOf(addr ma.Multiaddr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	for _, p := range []string{"quic", "ws", "tcp", "udp"} {
+		if _, err := addr.ValueForProtocol(ma.ProtocolWithName(p).Code); err == nil {
+			return p
+		}
+	}
+	return "unknown"
+}
+
+// dialFailureTransport returns the transport of the address a punch failed
+// at. If several addresses were dialed at once it is the transport they
+// share, or "unknown" if they differ.
+func dialFailureTransport(err error, dialed []ma.Multiaddr) string {
+	var de *DialError
+	if errors.As(err, &de) && de.Addr != nil {
+		return transportOf(de.Addr)
+	}
+	t := "unknown"
+	for i, addr := range dialed {
+		if i == 0 {
+			t = transportOf(addr)
+		} else if transportOf(addr) != t {
+			return "unknown"
+		}
+	}
+	return t
+}
+
+// dialFailureReasons are the reason metrics labels of the dial failure
+// classes.
+var dialFailureReasons = map[error]string{
+	ErrDialTimeout:      "timeout",
+	ErrConnRefused:      "refused",
+	ErrNoRoute:          "no_route",
+	ErrConnReset:        "reset",
+	ErrPeerIDMismatch:   "peer_id_mismatch",
+	ErrDialBackoff:      "backoff",
+	ErrAllAddrsFiltered: "filtered",
+}
+
+// dialFailureReason returns a coarse reason for a failed punch dial, as used
+// for the reason metrics label.
+func dialFailureReason(err error) string {
+	if r, ok := dialFailureReasons[classifyDialError(err)]; ok {
+		return r
+	}
+	return "other"
+}
@@ -0,0 +1,80 @@
+package ntraversal
+
+import (
+	"fmt"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func mustAddr(t testing.TB, s string) ma.Multiaddr {
+	t.Helper()
+	addr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestTransportOf(t *testing.T) {
+	cases := []struct {
+		addr string
+		want string
+	}{
+		{"/ip4/1.2.3.4/tcp/4001", "tcp"},
+		{"/ip6/::1/tcp/4001/ws", "ws"},
+		{"/ip4/1.2.3.4/udp/4001/quic", "quic"},
+		{"/ip4/1.2.3.4/udp/4001", "udp"},
+		{"/ip4/1.2.3.4", "unknown"},
+	}
+	for _, c := range cases {
+		if got := transportOf(mustAddr(t, c.addr)); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.addr, got, c.want)
+		}
+	}
+	if got := transportOf(nil); got != "unknown" {
+		t.Errorf("nil: got %s", got)
+	}
+}
+
+func TestDialFailureTransport(t *testing.T) {
+	tcp := mustAddr(t, "/ip4/1.2.3.4/tcp/4001")
+	tcp6 := mustAddr(t, "/ip6/::1/tcp/4001")
+	quic := mustAddr(t, "/ip4/1.2.3.4/udp/4001/quic")
+
+	cases := []struct {
+		name   string
+		err    error
+		dialed []ma.Multiaddr
+		want   string
+	}{
+		{"failing addr", &DialError{Addr: quic, Err: ErrDialTimeout}, []ma.Multiaddr{tcp, quic}, "quic"},
+		{"wrapped failing addr", fmt.Errorf("udp-punch: %w", &DialError{Addr: quic}), nil, "quic"},
+		{"shared transport", &DialError{Err: ErrConnRefused}, []ma.Multiaddr{tcp, tcp6}, "tcp"},
+		{"mixed transports", fmt.Errorf("failed"), []ma.Multiaddr{tcp, quic}, "unknown"},
+		{"nothing dialed", fmt.Errorf("failed"), nil, "unknown"},
+	}
+	for _, c := range cases {
+		if got := dialFailureTransport(c.err, c.dialed); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDialFailureReason(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{ErrDialTimeout, "timeout"},
+		{fmt.Errorf("dial tcp: connect: connection refused"), "refused"},
+		{&DialError{Class: ErrPeerIDMismatch}, "peer_id_mismatch"},
+		{fmt.Errorf("no good addresses"), "filtered"},
+		{fmt.Errorf("something else"), "other"},
+	}
+	for _, c := range cases {
+		if got := dialFailureReason(c.err); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// NATReport is the outcome of a NAT detection.
+type NATReport struct {
+	Type NATType
+	// Observed holds the address each service node saw us connecting from.
+	Observed map[peer.ID]ma.Multiaddr
+	// Local are the addresses of our own interfaces we listen on.
+	Local []ma.Multiaddr
+}
+
+// DetectNAT asks every connected service node which address it sees us
+// at and classifies our NAT from the answers:
+//
+//   - None if a service node sees one of our own addresses,
+//   - Symmetric if service nodes see different ports, i.e. the NAT maps
+//     each destination to a new port,
+//   - PortRestrictedCone if all of them see the same port. Filtering is
+//     not probed, so full and restricted cone NATs are reported as the
+//     most restrictive cone type,
+//   - Unknown if a single service node answered.
+//
+// The detected type is reported to service nodes with punch results and
+// emitted as EvtNATTypeChanged.
+func (b *NatTraversal) DetectNAT(ctx context.Context) (*NATReport, error) {
+	sns := b.ServiceNodes()
+	if len(sns) == 0 {
+		return nil, fmt.Errorf("not connected to any service node")
+	}
+
+	local, err := b.host.Network().InterfaceListenAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &NATReport{
+		Observed: make(map[peer.ID]ma.Multiaddr),
+		Local:    local,
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mux sync.Mutex
+	)
+	for _, sn := range sns {
+		wg.Add(1)
+		go func(sn peer.ID) {
+			defer wg.Done()
+
+			addr, err := b.probe(ctx, sn)
+			if err != nil {
+				log.Error("NAT probe to ", sn, " failed: ", err)
+				return
+			}
+			mux.Lock()
+			rep.Observed[sn] = addr
+			mux.Unlock()
+		}(sn)
+	}
+	wg.Wait()
+
+	if len(rep.Observed) == 0 {
+		return nil, fmt.Errorf("no service node answered the NAT probe")
+	}
+
+	rep.Type = classifyNAT(local, rep.Observed)
+	b.setNATType(rep.Type)
+	return rep, nil
+}
+
+// setNATType records the NAT type detected for this node and notifies
+// subscribers if it changed.
+func (b *NatTraversal) setNATType(t NATType) {
+	b.natMux.Lock()
+	changed := b.natType != t
+	b.natType = t
+	b.natMux.Unlock()
+
+	if changed {
+		b.events.emit(Event{Type: EvtNATTypeChanged, NATType: t})
+	}
+}
+
+// NATType returns the last detected NAT type of this node.
+func (b *NatTraversal) NATType() NATType {
+	b.natMux.Lock()
+	defer b.natMux.Unlock()
+	return b.natType
+}
+
+func classifyNAT(local []ma.Multiaddr, observed map[peer.ID]ma.Multiaddr) NATType {
+	var first ma.Multiaddr
+	for _, addr := range observed {
+		if containsAddr(local, addr) {
+			return NATNone
+		}
+		if first == nil {
+			first = addr
+		} else if !first.Equal(addr) {
+			return NATSymmetric
+		}
+	}
+	if len(observed) < 2 {
+		return NATUnknown
+	}
+	return NATPortRestrictedCone
+}
+
+// probe sends a NAT_PROBE to a service node and waits for its answer.
+func (b *NatTraversal) probe(ctx context.Context, sn peer.ID) (ma.Multiaddr, error) {
+	res := make(chan ma.Multiaddr, 1)
+
+	b.probeMux.Lock()
+	if _, ok := b.probes[sn]; ok {
+		b.probeMux.Unlock()
+		return nil, fmt.Errorf("probe to %s already in flight", sn.Pretty())
+	}
+	b.probes[sn] = res
+	b.probeMux.Unlock()
+
+	defer func() {
+		b.probeMux.Lock()
+		delete(b.probes, sn)
+		b.probeMux.Unlock()
+	}()
+
+	b.send(PacketWPeer{
+		peer:   sn,
+		packet: &protocol.Protocol{Type: protocol.Protocol_NAT_PROBE},
+	})
+
+	select {
+	case addr := <-res:
+		return addr, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleNATProbe answers a probe with the address the prober's traversal
+// stream comes from, or delivers an answer to the waiting probe.
+func (b *NatTraversal) handleNATProbe(m PacketWPeer) {
+	if m.packet.PeerInfo != nil {
+		addr, err := ma.NewMultiaddrBytes(m.packet.PeerInfo.Observed[0])
+		if err != nil {
+			log.Error("invalid observed address from ", m.peer, ": ", err)
+			return
+		}
+
+		b.probeMux.Lock()
+		res, ok := b.probes[m.peer]
+		b.probeMux.Unlock()
+		if ok {
+			select {
+			case res <- addr:
+			default:
+			}
+		}
+		return
+	}
+
+	sm, ok := b.getStreamWrapper(m.peer)
+	if !ok {
+		return
+	}
+	observed := (*sm.s).Conn().RemoteMultiaddr()
+
+	b.send(PacketWPeer{
+		peer: m.peer,
+		packet: &protocol.Protocol{
+			Type: protocol.Protocol_NAT_PROBE,
+			PeerInfo: &protocol.Protocol_PeerInfo{
+				Observed: [][]byte{observed.Bytes()},
+			},
+		},
+	})
+}
@@ -0,0 +1,232 @@
+package natsim
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	host "github.com/libp2p/go-libp2p-host"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+// punchRounds is the number of packets each side sends in the simulated
+// punch, matching the dial attempts of a real punch.
+const punchRounds = 3
+
+// Node is a simulated libp2p node running NAT traversal.
+type Node struct {
+	Host      host.Host
+	DHT       *dht.IpfsDHT
+	Traversal *ntraversal.NatTraversal
+	// NAT is the NAT the node is behind, nil for a public node.
+	NAT      *NAT
+	Internal Endpoint
+}
+
+// Harness wires a service node and two clients on a mock network. The
+// clients can always reach the service node, but are only linked to each
+// other once the simulated NATs let a coordinated punch through.
+type Harness struct {
+	Net     mocknet.Mocknet
+	Service *Node
+	A       *Node
+	B       *Node
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	punchOnce sync.Once
+	punchable bool
+	linkOnce  sync.Once
+
+	// relayed is closed once both clients reached the relay stage.
+	relayMux sync.Mutex
+	atRelay  int
+	relayed  chan struct{}
+}
+
+// New creates a harness with clients behind natA and natB, either of
+// which may be nil for a public client.
+func New(ctx context.Context, natA, natB *NAT) (*Harness, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h := &Harness{
+		Net:     mocknet.New(ctx),
+		ctx:     ctx,
+		cancel:  cancel,
+		relayed: make(chan struct{}),
+	}
+
+	var err error
+	if h.Service, err = h.newNode(nil, Endpoint{IP: "203.0.113.1", Port: 3000}, ntraversal.BootstrapServer); err != nil {
+		cancel()
+		return nil, err
+	}
+	pipeline := ntraversal.Pipeline(clientPipeline(h)...)
+	if h.A, err = h.newNode(natA, Endpoint{IP: "10.0.1.2", Port: 4001}, pipeline); err != nil {
+		cancel()
+		return nil, err
+	}
+	if h.B, err = h.newNode(natB, Endpoint{IP: "10.0.2.2", Port: 4001}, pipeline); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	for _, c := range []*Node{h.A, h.B} {
+		if _, err := h.Net.LinkPeers(h.Service.Host.ID(), c.Host.ID()); err != nil {
+			cancel()
+			return nil, err
+		}
+
+		addr := fmt.Sprintf("%s/ipfs/%s", h.Service.Host.Addrs()[0], h.Service.Host.ID().Pretty())
+		c.Traversal.ConnectToServiceNodes(ctx, []string{addr})
+	}
+
+	go h.watch(h.A)
+	go h.watch(h.B)
+
+	return h, nil
+}
+
+func (h *Harness) newNode(nat *NAT, internal Endpoint, opts ...ntraversal.Option) (*Node, error) {
+	hst, err := h.Net.GenPeer()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := dht.New(h.ctx, hst)
+	if err != nil {
+		return nil, err
+	}
+
+	nt, err := ntraversal.NewNatTraversal(h.ctx, hst, d, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Host:      hst,
+		DHT:       d,
+		Traversal: nt,
+		NAT:       nat,
+		Internal:  internal,
+	}, nil
+}
+
+// clientPipeline is the default pipeline with the relay replaced by one
+// the mock network can dial.
+func clientPipeline(h *Harness) []ntraversal.Stage {
+	stages := ntraversal.DefaultPipeline()
+	for i, st := range stages {
+		if st.Strategy.Name() == (ntraversal.Relay{}).Name() {
+			stages[i].Strategy = relay{h}
+		}
+	}
+	return stages
+}
+
+// relay stands in for a circuit relay through the service node. It links
+// the clients whatever their NATs are, once both gave up on direct
+// connections, as the link would let the direct dials through too.
+type relay struct {
+	h *Harness
+}
+
+func (relay) Name() string { return ntraversal.Relay{}.Name() }
+
+func (r relay) Connect(ctx context.Context, nt *ntraversal.NatTraversal, pi pstore.PeerInfo) error {
+	r.h.arriveAtRelay()
+	select {
+	case <-r.h.relayed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	r.h.link()
+	return nt.Dial(ctx, pi)
+}
+
+func (h *Harness) arriveAtRelay() {
+	h.relayMux.Lock()
+	defer h.relayMux.Unlock()
+
+	h.atRelay++
+	if h.atRelay == 2 {
+		close(h.relayed)
+	}
+}
+
+// link links the clients once.
+func (h *Harness) link() {
+	h.linkOnce.Do(func() {
+		h.Net.LinkPeers(h.A.Host.ID(), h.B.Host.ID())
+	})
+}
+
+// watch links the clients as soon as a dial attempt starts and the
+// simulated NATs allow the punch.
+func (h *Harness) watch(n *Node) {
+	evts, cancel := n.Traversal.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case evt := <-evts:
+			if evt.Type != ntraversal.EvtDialAttemptStarted {
+				continue
+			}
+			if h.Punchable() {
+				h.link()
+				return
+			}
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// Punchable reports whether the simulated NATs let a coordinated punch
+// between the clients through. The punch is simulated once per harness.
+func (h *Harness) Punchable() bool {
+	h.punchOnce.Do(func() {
+		h.punchable = Punch(h.A.NAT, h.A.Internal, h.B.NAT, h.B.Internal, h.Service.Internal, punchRounds)
+	})
+	return h.punchable
+}
+
+// Connect asks client A to punch a connection to client B and waits for
+// the result.
+func (h *Harness) Connect(ctx context.Context) error {
+	res, err := h.A.Traversal.ConnectThroughHolePunching(ctx, h.B.Host.ID())
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Punch asks client A to punch a connection to client B and returns the
+// result.
+func (h *Harness) Punch(ctx context.Context) (*ntraversal.PunchResult, error) {
+	return h.A.Traversal.Punch(ctx, h.B.Host.ID())
+}
+
+// Close shuts down all simulated nodes.
+func (h *Harness) Close() error {
+	h.cancel()
+	var err error
+	for _, n := range h.Net.Hosts() {
+		if cerr := n.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package natsim
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ntraversal "github.com/upperwal/go-libp2p-nat-traversal"
+)
+
+func TestHarness(t *testing.T) {
+	cases := []struct {
+		name   string
+		a, b   func() Config
+		direct bool
+	}{
+		{"public x symmetric", nil, Symmetric, true},
+		{"full cone x full cone", FullCone, FullCone, true},
+		{"full cone x symmetric", FullCone, Symmetric, true},
+		{"restricted x symmetric", RestrictedCone, Symmetric, true},
+		{"port restricted x port restricted", PortRestrictedCone, PortRestrictedCone, true},
+		{"port restricted x symmetric", PortRestrictedCone, Symmetric, false},
+		{"symmetric x symmetric", Symmetric, Symmetric, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			var natA *NAT
+			if c.a != nil {
+				natA = NewNAT(c.a(), "198.51.100.1")
+			}
+			h, err := New(ctx, natA, NewNAT(c.b(), "198.51.100.2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			res, err := h.Punch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relayed := res.Strategy == (ntraversal.Relay{}).Name()
+			if relayed == c.direct {
+				t.Fatalf("connected via %s, want direct=%v", res.Strategy, c.direct)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+// Package natsim simulates NAT devices so hole punching can be exercised
+// without real routers.
+//
+// A NAT is modelled after RFC 4787 by its mapping and filtering behaviour,
+// its port allocation and a mapping timeout. The classic cone/symmetric
+// types are provided as presets.
+package natsim
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Behavior is the mapping or filtering behaviour of a NAT.
+type Behavior int
+
+const (
+	// EndpointIndependent reuses a mapping (or accepts packets) regardless
+	// of the remote endpoint.
+	EndpointIndependent Behavior = iota
+	// AddressDependent depends on the remote IP address only.
+	AddressDependent
+	// AddressAndPortDependent depends on the remote IP address and port.
+	AddressAndPortDependent
+)
+
+// PortAllocation is how a NAT picks the external port of a new mapping.
+type PortAllocation int
+
+const (
+	// PortPreserving keeps the internal port when it is free.
+	PortPreserving PortAllocation = iota
+	// PortSequential allocates increasing ports.
+	PortSequential
+	// PortRandom allocates random ports.
+	PortRandom
+)
+
+// Config describes the behaviour of a simulated NAT.
+type Config struct {
+	Mapping    Behavior
+	Filtering  Behavior
+	Allocation PortAllocation
+	// MappingTimeout is how long an idle mapping is kept. Zero keeps
+	// mappings forever.
+	MappingTimeout time.Duration
+}
+
+// FullCone maps and accepts independently of the remote endpoint.
+func FullCone() Config {
+	return Config{Mapping: EndpointIndependent, Filtering: EndpointIndependent}
+}
+
+// RestrictedCone only accepts packets from addresses contacted before.
+func RestrictedCone() Config {
+	return Config{Mapping: EndpointIndependent, Filtering: AddressDependent}
+}
+
+// PortRestrictedCone only accepts packets from endpoints contacted before.
+func PortRestrictedCone() Config {
+	return Config{Mapping: EndpointIndependent, Filtering: AddressAndPortDependent}
+}
+
+// Symmetric creates a new mapping with a random port for every remote
+// endpoint.
+func Symmetric() Config {
+	return Config{
+		Mapping:    AddressAndPortDependent,
+		Filtering:  AddressAndPortDependent,
+		Allocation: PortRandom,
+	}
+}
+
+// Endpoint is an IP address and port pair.
+type Endpoint struct {
+	IP   string
+	Port int
+}
+
+func (e Endpoint) String() string {
+	return fmt.Sprintf("%s:%d", e.IP, e.Port)
+}
+
+type mapping struct {
+	internal  Endpoint
+	external  Endpoint
+	contacted map[Endpoint]struct{}
+	lastUsed  time.Time
+}
+
+type mappingKey struct {
+	internal Endpoint
+	remote   Endpoint
+}
+
+// NAT is a simulated NAT device with a single public IP address.
+type NAT struct {
+	cfg      Config
+	publicIP string
+	now      func() time.Time
+
+	mux      sync.Mutex
+	rnd      *rand.Rand
+	nextPort int
+	mappings map[mappingKey]*mapping
+	ports    map[int]*mapping
+}
+
+// NewNAT creates a NAT translating to publicIP.
+func NewNAT(cfg Config, publicIP string) *NAT {
+	return &NAT{
+		cfg:      cfg,
+		publicIP: publicIP,
+		now:      time.Now,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		nextPort: 40000,
+		mappings: make(map[mappingKey]*mapping),
+		ports:    make(map[int]*mapping),
+	}
+}
+
+// SetClock replaces the time source, which lets callers expire mappings
+// without sleeping.
+func (n *NAT) SetClock(now func() time.Time) {
+	n.mux.Lock()
+	n.now = now
+	n.mux.Unlock()
+}
+
+// Config returns the behaviour of the NAT.
+func (n *NAT) Config() Config {
+	return n.cfg
+}
+
+func (n *NAT) key(internal, remote Endpoint) mappingKey {
+	switch n.cfg.Mapping {
+	case AddressDependent:
+		return mappingKey{internal, Endpoint{IP: remote.IP}}
+	case AddressAndPortDependent:
+		return mappingKey{internal, remote}
+	default:
+		return mappingKey{internal: internal}
+	}
+}
+
+func (n *NAT) expired(m *mapping, now time.Time) bool {
+	return n.cfg.MappingTimeout > 0 && now.Sub(m.lastUsed) > n.cfg.MappingTimeout
+}
+
+func (n *NAT) allocPort(internal Endpoint) int {
+	free := func(p int) bool {
+		m, ok := n.ports[p]
+		return !ok || n.expired(m, n.now())
+	}
+
+	switch n.cfg.Allocation {
+	case PortPreserving:
+		if free(internal.Port) {
+			return internal.Port
+		}
+	case PortRandom:
+		for {
+			p := 1024 + n.rnd.Intn(65535-1024)
+			if free(p) {
+				return p
+			}
+		}
+	}
+
+	for !free(n.nextPort) {
+		n.nextPort++
+	}
+	p := n.nextPort
+	n.nextPort++
+	return p
+}
+
+// Outbound translates a packet sent from the internal endpoint to remote
+// and returns the external source endpoint seen by remote.
+func (n *NAT) Outbound(internal, remote Endpoint) Endpoint {
+	if n == nil {
+		return internal
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	now := n.now()
+	k := n.key(internal, remote)
+
+	m, ok := n.mappings[k]
+	if !ok || n.expired(m, now) {
+		m = &mapping{
+			internal:  internal,
+			external:  Endpoint{IP: n.publicIP, Port: n.allocPort(internal)},
+			contacted: make(map[Endpoint]struct{}),
+		}
+		n.mappings[k] = m
+		n.ports[m.external.Port] = m
+	}
+
+	m.lastUsed = now
+	m.contacted[remote] = struct{}{}
+	return m.external
+}
+
+// Inbound translates a packet sent from remote to the external endpoint
+// of the NAT. It returns the internal destination and whether the packet
+// passes the filter.
+func (n *NAT) Inbound(remote, external Endpoint) (Endpoint, bool) {
+	if n == nil {
+		return external, true
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	m, ok := n.ports[external.Port]
+	if !ok || external.IP != n.publicIP || n.expired(m, n.now()) {
+		return Endpoint{}, false
+	}
+
+	switch n.cfg.Filtering {
+	case AddressDependent:
+		for c := range m.contacted {
+			if c.IP == remote.IP {
+				return m.internal, true
+			}
+		}
+		return Endpoint{}, false
+	case AddressAndPortDependent:
+		if _, ok := m.contacted[remote]; !ok {
+			return Endpoint{}, false
+		}
+	}
+
+	return m.internal, true
+}
+
+// Punch simulates a hole punch coordinated by a service node at server
+// between a host at internal endpoint a behind natA and one at b behind
+// natB. A nil NAT stands for a host with a public address. Both sides
+// learn the endpoint observed by the service node and send rounds packets
+// to each other; Punch reports whether any packet was delivered.
+func Punch(natA *NAT, a Endpoint, natB *NAT, b Endpoint, server Endpoint, rounds int) bool {
+	extA := natA.Outbound(a, server)
+	extB := natB.Outbound(b, server)
+
+	for i := 0; i < rounds; i++ {
+		src := natA.Outbound(a, extB)
+		if _, ok := natB.Inbound(src, extB); ok {
+			return true
+		}
+
+		src = natB.Outbound(b, extA)
+		if _, ok := natA.Inbound(src, extA); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package natsim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPunch(t *testing.T) {
+	type preset func() Config
+	public := preset(nil)
+
+	cases := []struct {
+		name string
+		a, b preset
+		want bool
+	}{
+		{"public x symmetric", public, Symmetric, true},
+		{"full cone x full cone", FullCone, FullCone, true},
+		{"full cone x symmetric", FullCone, Symmetric, true},
+		{"restricted x symmetric", RestrictedCone, Symmetric, true},
+		{"port restricted x port restricted", PortRestrictedCone, PortRestrictedCone, true},
+		{"port restricted x symmetric", PortRestrictedCone, Symmetric, false},
+		{"symmetric x port restricted", Symmetric, PortRestrictedCone, false},
+		{"symmetric x symmetric", Symmetric, Symmetric, false},
+	}
+
+	server := Endpoint{IP: "203.0.113.1", Port: 3000}
+	a := Endpoint{IP: "10.0.1.2", Port: 4001}
+	b := Endpoint{IP: "10.0.2.2", Port: 4001}
+	newNAT := func(p preset, ip string) *NAT {
+		if p == nil {
+			return nil
+		}
+		return NewNAT(p(), ip)
+	}
+
+	for _, c := range cases {
+		natA := newNAT(c.a, "198.51.100.1")
+		natB := newNAT(c.b, "198.51.100.2")
+		if got := Punch(natA, a, natB, b, server, punchRounds); got != c.want {
+			t.Errorf("%s: punch = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMappingTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	cfg := FullCone()
+	cfg.MappingTimeout = time.Minute
+	n := NewNAT(cfg, "198.51.100.1")
+	n.SetClock(func() time.Time { return now })
+
+	internal := Endpoint{IP: "10.0.1.2", Port: 4001}
+	remote := Endpoint{IP: "203.0.113.1", Port: 3000}
+	ext := n.Outbound(internal, remote)
+
+	if _, ok := n.Inbound(Endpoint{IP: "192.0.2.7", Port: 9}, ext); !ok {
+		t.Fatal("full cone dropped a packet on a live mapping")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := n.Inbound(remote, ext); ok {
+		t.Fatal("packet passed an expired mapping")
+	}
+}
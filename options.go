@@ -1,7 +1,185 @@
 package ntraversal
 
-type Option int
+import (
+	"fmt"
+	"time"
 
-const (
-	BootstrapServer = iota
+	peer "github.com/libp2p/go-libp2p-peer"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
+
+// Option configures a NatTraversal instance.
+type Option func(cfg *config) error
+
+type config struct {
+	serviceNode bool
+	maxMsgSize  int
+	metricsReg  prometheus.Registerer
+	tracer      trace.Tracer
+
+	upgradeRelayed bool
+	portMappers    []PortMapper
+	pipeline       []Stage
+	dialer         AddrDialer
+	dialStagger    time.Duration
+	retry          RetryPolicy
+
+	authorize func(peer.ID) bool
+	rateLimit float64
+	rateBurst int
+}
+
+// defaultMaxMsgSize bounds a single delimited protocol message. Messages
+// only carry a peer ID or a JSON encoded peer info so this is generous.
+const defaultMaxMsgSize = 64 << 10
+
+func defaultConfig() *config {
+	return &config{
+		maxMsgSize:  defaultMaxMsgSize,
+		pipeline:    DefaultPipeline(),
+		dialStagger: defaultDialStagger,
+		retry:       DefaultRetryPolicy(),
+	}
+}
+
+func (cfg *config) apply(opts ...Option) error {
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BootstrapServer marks the node as a service node which coordinates hole
+// punching for other peers.
+var BootstrapServer Option = func(cfg *config) error {
+	cfg.serviceNode = true
+	return nil
+}
+
+// MaxMessageSize sets the largest protocol message (in bytes) accepted from
+// a remote peer. Streams sending bigger messages are closed.
+func MaxMessageSize(size int) Option {
+	return func(cfg *config) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid max message size: %d", size)
+		}
+		cfg.maxMsgSize = size
+		return nil
+	}
+}
+
+// MetricsRegistry registers the traversal metrics with reg.
+func MetricsRegistry(reg prometheus.Registerer) Option {
+	return func(cfg *config) error {
+		cfg.metricsReg = reg
+		return nil
+	}
+}
+
+// Retry sets the policy for repeating punch dials. WithRetryPolicy
+// overrides it for a single punch.
+func Retry(p RetryPolicy) Option {
+	return func(cfg *config) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		cfg.retry = p
+		return nil
+	}
+}
+
+// Tracer exports a span for every punch, with a child span per step of
+// its trace.
+func Tracer(t trace.Tracer) Option {
+	return func(cfg *config) error {
+		cfg.tracer = t
+		return nil
+	}
+}
+
+// UpgradeRelayed makes the node replace relayed connections with direct
+// ones by punching through the relayed connection itself. Both peers need
+// the option enabled.
+var UpgradeRelayed Option = func(cfg *config) error {
+	cfg.upgradeRelayed = true
+	return nil
+}
+
+// PortMapping makes the node map its listen ports on the router in front
+// of it and announce the mapped addresses to its service nodes. The
+// mappers are tried in order; without any, DefaultPortMappers are used.
+func PortMapping(mappers ...PortMapper) Option {
+	return func(cfg *config) error {
+		if len(mappers) == 0 {
+			mappers = DefaultPortMappers()
+		}
+		cfg.portMappers = mappers
+		return nil
+	}
+}
+
+// Pipeline replaces the traversal strategies tried, in order, when asked to
+// punch to a peer. Service nodes suggest trying the strategies which
+// connected most peers behind the same NAT types first.
+func Pipeline(stages ...Stage) Option {
+	return func(cfg *config) error {
+		if len(stages) == 0 {
+			return fmt.Errorf("empty traversal pipeline")
+		}
+		for _, st := range stages {
+			if st.Strategy == nil || st.Timeout <= 0 {
+				return fmt.Errorf("traversal stage needs a strategy and a timeout")
+			}
+		}
+		cfg.pipeline = stages
+		return nil
+	}
+}
+
+// DialStagger sets the delay between starting dials to the ranked
+// addresses of a peer while punching. Zero starts all dials at once, in
+// ranked order.
+func DialStagger(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return fmt.Errorf("negative dial stagger: %s", d)
+		}
+		cfg.dialStagger = d
+		return nil
+	}
+}
+
+// WithAddrDialer replaces how a single punch candidate is dialed. By
+// default TCP candidates are dialed on the PunchTransport of the host, if
+// it has one, and all others through the host.
+func WithAddrDialer(d AddrDialer) Option {
+	return func(cfg *config) error {
+		cfg.dialer = d
+		return nil
+	}
+}
+
+// Authorize restricts the peers a service node coordinates punches for to
+// those for which allow returns true.
+func Authorize(allow func(p peer.ID) bool) Option {
+	return func(cfg *config) error {
+		cfg.authorize = allow
+		return nil
+	}
+}
+
+// RateLimit limits every peer to perSec connection requests per second to
+// a service node, allowing bursts of up to burst requests.
+func RateLimit(perSec float64, burst int) Option {
+	return func(cfg *config) error {
+		if perSec <= 0 || burst <= 0 {
+			return fmt.Errorf("invalid rate limit: %v/s with burst %d", perSec, burst)
+		}
+		cfg.rateLimit = perSec
+		cfg.rateBurst = burst
+		return nil
+	}
+}
@@ -0,0 +1,144 @@
+package ntraversal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Port Control Protocol (RFC 6887) constants.
+const (
+	pcpPort       = 5351
+	pcpVersion    = 2
+	pcpOpMap      = 1
+	pcpResponse   = 0x80
+	pcpHeaderLen  = 24
+	pcpMapLen     = 36
+	pcpRetries    = 3
+	pcpRetryDelay = 2 * time.Second
+)
+
+// PCPMapper maps ports with the Port Control Protocol.
+type PCPMapper struct {
+	server *net.UDPAddr
+}
+
+// NewPCPMapper creates a mapper talking to the PCP server at server,
+// usually port 5351 of the default gateway.
+func NewPCPMapper(server *net.UDPAddr) *PCPMapper {
+	return &PCPMapper{server: server}
+}
+
+// Name implements PortMapper.
+func (m *PCPMapper) Name() string {
+	return "pcp"
+}
+
+// Map implements PortMapper. The external address assigned by the server
+// must be public.
+func (m *PCPMapper) Map(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (net.IP, int, error) {
+	ip, port, err := m.request(ctx, protocol, internalPort, lifetime)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := validMapping(ip, port); err != nil {
+		return nil, 0, fmt.Errorf("pcp server %s: %s", m.server, err)
+	}
+	return ip, port, nil
+}
+
+// Unmap implements PortMapper. A mapping is deleted by requesting a zero
+// lifetime.
+func (m *PCPMapper) Unmap(ctx context.Context, protocol string, internalPort int) error {
+	_, _, err := m.request(ctx, protocol, internalPort, 0)
+	return err
+}
+
+func (m *PCPMapper) request(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (net.IP, int, error) {
+	var proto byte
+	switch protocol {
+	case "tcp":
+		proto = 6
+	case "udp":
+		proto = 17
+	default:
+		return nil, 0, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
+	conn, err := net.DialUDP("udp", nil, m.server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, 0, err
+	}
+
+	req := make([]byte, pcpHeaderLen+pcpMapLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+
+	mp := req[pcpHeaderLen:]
+	copy(mp[0:12], nonce[:])
+	mp[12] = proto
+	binary.BigEndian.PutUint16(mp[16:18], uint16(internalPort))
+	// Suggest the internal port, any external address.
+	binary.BigEndian.PutUint16(mp[18:20], uint16(internalPort))
+	copy(mp[20:36], net.IPv6zero)
+
+	res := make([]byte, 1100)
+	for i := 0; i < pcpRetries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, 0, err
+		}
+
+		deadline := time.Now().Add(pcpRetryDelay)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, err := conn.Read(res)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && ctx.Err() == nil {
+				continue
+			}
+			return nil, 0, err
+		}
+		return parsePCPMapResponse(res[:n], nonce[:], proto, internalPort)
+	}
+	return nil, 0, fmt.Errorf("no response from pcp server %s", m.server)
+}
+
+func parsePCPMapResponse(res []byte, nonce []byte, proto byte, internalPort int) (net.IP, int, error) {
+	if len(res) < pcpHeaderLen+pcpMapLen {
+		return nil, 0, fmt.Errorf("short pcp response: %d bytes", len(res))
+	}
+	if res[0] != pcpVersion || res[1] != pcpResponse|pcpOpMap {
+		return nil, 0, fmt.Errorf("unexpected pcp response: version %d opcode %d", res[0], res[1])
+	}
+	if code := res[3]; code != 0 {
+		return nil, 0, fmt.Errorf("pcp server refused mapping: result code %d", code)
+	}
+
+	mp := res[pcpHeaderLen:]
+	if !bytes.Equal(mp[0:12], nonce) || mp[12] != proto ||
+		int(binary.BigEndian.Uint16(mp[16:18])) != internalPort {
+		return nil, 0, fmt.Errorf("pcp response does not match request")
+	}
+
+	port := int(binary.BigEndian.Uint16(mp[18:20]))
+	ip := net.IP(append([]byte(nil), mp[20:36]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, port, nil
+}
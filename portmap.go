@@ -0,0 +1,446 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	gonat "github.com/libp2p/go-nat"
+	ma "github.com/multiformats/go-multiaddr"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+const (
+	// mappingLifetime is the lifetime requested for port mappings. They
+	// are renewed halfway through.
+	mappingLifetime = 30 * time.Minute
+
+	mappingTimeout = 10 * time.Second
+
+	// registerAddrTTL is how long a service node keeps addresses announced
+	// by a client.
+	registerAddrTTL = mappingLifetime
+	// maxRegisterAddrs bounds the addresses a client can announce.
+	maxRegisterAddrs = 8
+)
+
+// cgnatNet is the shared address space of carrier-grade NATs (RFC 6598),
+// which is not reachable from the internet either.
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// validMapping checks an external address reported by a gateway, which
+// is announced to service nodes and dialed by other peers.
+func validMapping(ip net.IP, port int) error {
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		return fmt.Errorf("no external address")
+	case !isPublicIP(ip):
+		return fmt.Errorf("external address %s is not public", ip)
+	case port <= 0 || port > 65535:
+		return fmt.Errorf("invalid external port %d", port)
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is reachable from the internet, i.e. it is
+// not loopback, private, link-local, multicast or carrier-grade NAT space.
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsUnspecified() && !ip.IsLoopback() && !ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !cgnatNet.Contains(ip)
+}
+
+// addrIP returns the IP address of addr, or nil.
+func addrIP(addr ma.Multiaddr) net.IP {
+	if ip, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		return net.ParseIP(ip)
+	}
+	if ip, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+		return net.ParseIP(ip)
+	}
+	return nil
+}
+
+// PortMapper opens a port on the router in front of this node.
+type PortMapper interface {
+	// Name identifies the mapping protocol, e.g. "upnp" or "pcp".
+	Name() string
+	// Map forwards the external port returned to internalPort of protocol
+	// ("tcp" or "udp") on this node for lifetime.
+	Map(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (net.IP, int, error)
+	// Unmap removes a mapping created by Map.
+	Unmap(ctx context.Context, protocol string, internalPort int) error
+}
+
+// DefaultPortMappers returns mappers for UPnP IGD and NAT-PMP, whichever
+// the gateway answers first, followed by PCP.
+func DefaultPortMappers() []PortMapper {
+	mappers := []PortMapper{&gonatMapper{}}
+	if gw := guessGateway(); gw != nil {
+		mappers = append(mappers, NewPCPMapper(&net.UDPAddr{IP: gw, Port: pcpPort}))
+	}
+	return mappers
+}
+
+// gonatMapper maps ports through UPnP IGD or NAT-PMP. The calls of go-nat
+// cannot be cancelled, so they run in the background when ctx is done
+// first, and a mapping made after Map gave up is removed again.
+type gonatMapper struct {
+	// discover finds the gateway, gonat.DiscoverGateway if nil.
+	discover func() (gonat.NAT, error)
+
+	mux sync.Mutex
+	nat gonat.NAT
+}
+
+func (m *gonatMapper) Name() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.nat != nil {
+		return m.nat.Type()
+	}
+	return "upnp/nat-pmp"
+}
+
+func (m *gonatMapper) gateway() (gonat.NAT, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.nat == nil {
+		discover := m.discover
+		if discover == nil {
+			discover = gonat.DiscoverGateway
+		}
+		nat, err := discover()
+		if err != nil {
+			return nil, err
+		}
+		m.nat = nat
+	}
+	return m.nat, nil
+}
+
+type gonatMapping struct {
+	ip   net.IP
+	port int
+	err  error
+}
+
+func (m *gonatMapper) Map(ctx context.Context, protocol string, internalPort int, lifetime time.Duration) (net.IP, int, error) {
+	done := make(chan gonatMapping)
+	go func() {
+		nat, err := m.gateway()
+		if err != nil {
+			m.deliver(ctx, done, gonatMapping{err: err}, nil)
+			return
+		}
+		ip, err := nat.GetExternalAddress()
+		if err != nil {
+			m.deliver(ctx, done, gonatMapping{err: err}, nil)
+			return
+		}
+		port, err := nat.AddPortMapping(protocol, internalPort, "ntraversal", lifetime)
+		m.deliver(ctx, done, gonatMapping{ip: ip, port: port, err: err}, func() {
+			if err == nil {
+				nat.DeletePortMapping(protocol, internalPort)
+			}
+		})
+	}()
+
+	select {
+	case r := <-done:
+		return r.ip, r.port, r.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// deliver hands r to Map, or runs abandoned if Map already gave up.
+func (m *gonatMapper) deliver(ctx context.Context, done chan<- gonatMapping, r gonatMapping, abandoned func()) {
+	select {
+	case done <- r:
+	case <-ctx.Done():
+		if abandoned != nil {
+			abandoned()
+		}
+	}
+}
+
+func (m *gonatMapper) Unmap(ctx context.Context, protocol string, internalPort int) error {
+	done := make(chan error, 1)
+	go func() {
+		nat, err := m.gateway()
+		if err == nil {
+			err = nat.DeletePortMapping(protocol, internalPort)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// guessGateway returns the .1 address of the first private IPv4 network
+// of this node, which is where consumer routers usually sit.
+func guessGateway() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP.To4()
+		if ip == nil || ip.IsLoopback() || !isPrivateIP4(ip) {
+			continue
+		}
+		gw := ip.Mask(ipnet.Mask)
+		gw[3] |= 1
+		return gw
+	}
+	return nil
+}
+
+func isPrivateIP4(ip net.IP) bool {
+	return ip[0] == 10 ||
+		(ip[0] == 172 && ip[1]&0xf0 == 16) ||
+		(ip[0] == 192 && ip[1] == 168)
+}
+
+// portMapping is a listen port mapped on the router.
+type portMapping struct {
+	mapper   PortMapper
+	protocol string
+	port     int
+	addr     ma.Multiaddr
+}
+
+// mapPorts maps the TCP listen ports of the host with the first mapper
+// that works.
+func (b *NatTraversal) mapPorts(ctx context.Context) []portMapping {
+	var mapped []portMapping
+
+	for _, laddr := range b.host.Network().ListenAddresses() {
+		sport, err := laddr.ValueForProtocol(ma.P_TCP)
+		if err != nil {
+			continue
+		}
+		var port int
+		if _, err := fmt.Sscan(sport, &port); err != nil {
+			continue
+		}
+
+		for _, m := range b.cfg.portMappers {
+			mctx, cancel := context.WithTimeout(ctx, mappingTimeout)
+			ip, eport, err := m.Map(mctx, "tcp", port, mappingLifetime)
+			cancel()
+			if err == nil {
+				err = validMapping(ip, eport)
+			}
+			if err != nil {
+				log.Info("Port mapping with ", m.Name(), " failed: ", err)
+				continue
+			}
+
+			addr, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s/tcp/%d", ipProto(ip), ip, eport))
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			log.Info("Mapped ", laddr, " to ", addr, " with ", m.Name())
+			mapped = append(mapped, portMapping{mapper: m, protocol: "tcp", port: port, addr: addr})
+			break
+		}
+	}
+	return mapped
+}
+
+// unmapPorts removes the mappings of old which are not in current.
+func unmapPorts(old, current []portMapping) {
+	for _, pm := range old {
+		renewed := false
+		for _, c := range current {
+			if c.mapper == pm.mapper && c.protocol == pm.protocol && c.port == pm.port {
+				renewed = true
+				break
+			}
+		}
+		if renewed {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), mappingTimeout)
+		if err := pm.mapper.Unmap(ctx, pm.protocol, pm.port); err != nil {
+			log.Info("Removing port mapping of ", pm.addr, " with ", pm.mapper.Name(), " failed: ", err)
+		}
+		cancel()
+	}
+}
+
+func ipProto(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// portMapLoop keeps the listen ports mapped and announces the mapped
+// addresses to the service nodes until ctx is done, then removes the
+// mappings. Peers then dial us on a mapped address directly and only need
+// to punch when mapping failed.
+func (b *NatTraversal) portMapLoop(ctx context.Context) {
+	defer close(b.portMapDone)
+
+	var mappings []portMapping
+	for {
+		current := b.mapPorts(ctx)
+		unmapPorts(mappings, current)
+		mappings = current
+
+		addrs := make([]ma.Multiaddr, 0, len(mappings))
+		for _, pm := range mappings {
+			addrs = append(addrs, pm.addr)
+		}
+
+		b.mappedMux.Lock()
+		b.mappedAddrs = addrs
+		b.mappedMux.Unlock()
+
+		if len(addrs) > 0 {
+			b.bootstrapPeers.mux.Lock()
+			sns := append([]peer.ID(nil), b.serviceNodes...)
+			b.bootstrapPeers.mux.Unlock()
+
+			for _, sn := range sns {
+				b.sendRegister(sn)
+			}
+		}
+
+		select {
+		case <-time.After(mappingLifetime / 2):
+		case <-ctx.Done():
+			unmapPorts(mappings, nil)
+			return
+		}
+	}
+}
+
+// MappedAddrs returns the external addresses obtained by port mapping.
+func (b *NatTraversal) MappedAddrs() []ma.Multiaddr {
+	b.mappedMux.Lock()
+	defer b.mappedMux.Unlock()
+	return append([]ma.Multiaddr(nil), b.mappedAddrs...)
+}
+
+// sendRegister announces the mapped addresses of this node to a service
+// node. It does nothing while no port is mapped.
+func (b *NatTraversal) sendRegister(to peer.ID) {
+	addrs := b.MappedAddrs()
+	if len(addrs) == 0 {
+		return
+	}
+
+	pi := pstore.PeerInfo{ID: b.host.ID(), Addrs: addrs}
+	data, err := pi.MarshalJSON()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	b.send(PacketWPeer{
+		peer: to,
+		packet: &protocol.Protocol{
+			Type:     protocol.Protocol_REGISTER,
+			PeerInfo: &protocol.Protocol_PeerInfo{Info: data},
+		},
+	})
+}
+
+// handleRegister records the addresses a client announced, so they are
+// handed out when coordinating punches with it.
+func (b *NatTraversal) handleRegister(m PacketWPeer) {
+	pi := pstore.PeerInfo{}
+	if err := pi.UnmarshalJSON(m.packet.PeerInfo.Info); err != nil {
+		b.sendErrMessage(m.peer, "", fmt.Errorf("invalid peer info: %s", err))
+		return
+	}
+	if pi.ID != m.peer {
+		b.sendErrMessage(m.peer, "", fmt.Errorf("cannot register addresses of another peer"))
+		return
+	}
+
+	addrs := b.registrableAddrs(m.peer, pi.Addrs)
+	if len(addrs) == 0 {
+		b.sendErrMessage(m.peer, "", fmt.Errorf("no valid address to register"))
+		return
+	}
+
+	log.Info("Registered addresses of ", m.peer, ": ", addrs)
+	b.host.Peerstore().AddAddrs(pi.ID, addrs, registerAddrTTL)
+}
+
+// registrableAddrs returns the addresses announced by p which are handed
+// out to other peers: public TCP or UDP addresses on an IP we see p
+// connect from, as mapped ports are on the external address of the router
+// of p. Others could make peers dial a victim.
+func (b *NatTraversal) registrableAddrs(p peer.ID, announced []ma.Multiaddr) []ma.Multiaddr {
+	var observed []net.IP
+	for _, c := range b.host.Network().ConnsToPeer(p) {
+		if isRelayAddr(c.RemoteMultiaddr()) {
+			continue
+		}
+		if ip := addrIP(c.RemoteMultiaddr()); ip != nil {
+			observed = append(observed, ip)
+		}
+	}
+
+	var addrs []ma.Multiaddr
+	for _, addr := range announced {
+		if len(addrs) == maxRegisterAddrs {
+			log.Info("Dropping addresses beyond ", maxRegisterAddrs, " registered by ", p)
+			break
+		}
+		if !registrable(addr, observed) {
+			log.Info("Dropping address ", addr, " registered by ", p)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func registrable(addr ma.Multiaddr, observed []net.IP) bool {
+	if isRelayAddr(addr) {
+		return false
+	}
+	sport, err := addr.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		if sport, err = addr.ValueForProtocol(ma.P_UDP); err != nil {
+			return false
+		}
+	}
+	var port int
+	if _, err := fmt.Sscan(sport, &port); err != nil {
+		return false
+	}
+	ip := addrIP(addr)
+	if validMapping(ip, port) != nil {
+		return false
+	}
+	for _, o := range observed {
+		if o.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
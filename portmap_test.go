@@ -0,0 +1,278 @@
+package ntraversal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	gonat "github.com/libp2p/go-nat"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// fakeIGD is a UPnP IGD or NAT-PMP gateway keeping its mappings in memory.
+type fakeIGD struct {
+	external net.IP
+	// block, if not nil, delays AddPortMapping until it is closed.
+	block chan struct{}
+
+	mux      sync.Mutex
+	mappings map[string]int
+	added    int
+}
+
+func newFakeIGD(external string) *fakeIGD {
+	return &fakeIGD{external: net.ParseIP(external), mappings: make(map[string]int)}
+}
+
+func (g *fakeIGD) Type() string                        { return "fake-igd" }
+func (g *fakeIGD) GetDeviceAddress() (net.IP, error)   { return net.IPv4(192, 168, 1, 1), nil }
+func (g *fakeIGD) GetInternalAddress() (net.IP, error) { return net.IPv4(192, 168, 1, 2), nil }
+func (g *fakeIGD) GetExternalAddress() (net.IP, error) { return g.external, nil }
+
+func (g *fakeIGD) key(protocol string, port int) string {
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+func (g *fakeIGD) mapped(protocol string, port int) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	_, ok := g.mappings[g.key(protocol, port)]
+	return ok
+}
+
+func (g *fakeIGD) count() int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.mappings)
+}
+
+func (g *fakeIGD) AddPortMapping(protocol string, internalPort int, desc string, timeout time.Duration) (int, error) {
+	if g.block != nil {
+		<-g.block
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.mappings[g.key(protocol, internalPort)] = internalPort + 10000
+	g.added++
+	return internalPort + 10000, nil
+}
+
+func (g *fakeIGD) DeletePortMapping(protocol string, internalPort int) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	delete(g.mappings, g.key(protocol, internalPort))
+	return nil
+}
+
+func TestGonatMapper(t *testing.T) {
+	igd := newFakeIGD("203.0.113.7")
+	m := &gonatMapper{discover: func() (gonat.NAT, error) { return igd, nil }}
+
+	if name := m.Name(); name != "upnp/nat-pmp" {
+		t.Errorf("name before discovery %q", name)
+	}
+	ip, port, err := m.Map(context.Background(), "tcp", 4001, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(igd.external) || port != 14001 {
+		t.Fatalf("mapped to %s:%d", ip, port)
+	}
+	if name := m.Name(); name != "fake-igd" {
+		t.Errorf("name after discovery %q", name)
+	}
+	if err := m.Unmap(context.Background(), "tcp", 4001); err != nil {
+		t.Fatal(err)
+	}
+	if igd.mapped("tcp", 4001) {
+		t.Fatal("mapping not removed")
+	}
+}
+
+func TestGonatMapperContext(t *testing.T) {
+	igd := newFakeIGD("203.0.113.7")
+	igd.block = make(chan struct{})
+	m := &gonatMapper{discover: func() (gonat.NAT, error) { return igd, nil }}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := m.Map(ctx, "tcp", 4001, time.Minute); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The gateway maps the port after Map gave up, which removes it.
+	close(igd.block)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		igd.mux.Lock()
+		done := igd.added == 1 && len(igd.mappings) == 0
+		igd.mux.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned mapping not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGonatMapperNoGateway(t *testing.T) {
+	m := &gonatMapper{discover: func() (gonat.NAT, error) { return nil, gonat.ErrNoNATFound }}
+	if _, _, err := m.Map(context.Background(), "tcp", 4001, time.Minute); err != gonat.ErrNoNATFound {
+		t.Fatalf("got %v, want %v", err, gonat.ErrNoNATFound)
+	}
+}
+
+// fakePCPServer answers MAP requests with the external address ip and the
+// result code, on a local UDP port.
+func fakePCPServer(t *testing.T, ip string, code byte) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < pcpHeaderLen+pcpMapLen {
+				continue
+			}
+			res := make([]byte, pcpHeaderLen+pcpMapLen)
+			res[0] = pcpVersion
+			res[1] = pcpResponse | buf[1]
+			res[3] = code
+			copy(res[4:8], buf[4:8])
+			mp := res[pcpHeaderLen:]
+			copy(mp, buf[pcpHeaderLen:pcpHeaderLen+pcpMapLen])
+			port := binary.BigEndian.Uint16(mp[16:18])
+			binary.BigEndian.PutUint16(mp[18:20], port+10000)
+			copy(mp[20:36], net.ParseIP(ip).To16())
+			conn.WriteToUDP(res, from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPCPMapper(t *testing.T) {
+	cases := []struct {
+		name    string
+		ip      string
+		code    byte
+		wantErr bool
+	}{
+		{"public", "203.0.113.7", 0, false},
+		{"private", "192.168.1.1", 0, true},
+		{"carrier-grade nat", "100.64.1.1", 0, true},
+		{"unspecified", "0.0.0.0", 0, true},
+		{"refused", "203.0.113.7", 2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewPCPMapper(fakePCPServer(t, c.ip, c.code))
+			ip, port, err := m.Map(context.Background(), "tcp", 4001, time.Minute)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+			if err == nil && (ip.String() != c.ip || port != 14001) {
+				t.Fatalf("mapped to %s:%d", ip, port)
+			}
+		})
+	}
+}
+
+func TestPortMapLoopUnmapsOnClose(t *testing.T) {
+	igd := newFakeIGD("203.0.113.7")
+	b := newTestTraversal(t, nil, PortMapping(&gonatMapper{discover: func() (gonat.NAT, error) { return igd, nil }}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.MappedAddrs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no port mapped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Close()
+	if n := igd.count(); n != 0 {
+		t.Fatalf("%d mappings left after Close", n)
+	}
+}
+
+func TestRegistrableAddrs(t *testing.T) {
+	mn := mocknet.New(context.Background())
+	sn := newTestTraversalOn(t, mn, stubRouter{}, BootstrapServer)
+	c := newTestClient(t, mn, sn)
+
+	observed := addrIP(sn.host.Network().ConnsToPeer(c.host.ID())[0].RemoteMultiaddr())
+	at := func(format string) string { return fmt.Sprintf(format, observed) }
+
+	many := make([]string, maxRegisterAddrs+1)
+	for i := range many {
+		many[i] = at(fmt.Sprintf("/ip6/%%s/tcp/%d", 5000+i))
+	}
+
+	cases := []struct {
+		name      string
+		announced []string
+		want      int
+	}{
+		{"observed tcp", []string{at("/ip6/%s/tcp/5000")}, 1},
+		{"observed udp", []string{at("/ip6/%s/udp/5000/quic")}, 1},
+		{"other public ip", []string{"/ip4/203.0.113.7/tcp/5000"}, 0},
+		{"private", []string{"/ip4/192.168.1.2/tcp/5000"}, 0},
+		{"loopback", []string{"/ip4/127.0.0.1/tcp/5000"}, 0},
+		{"zero port", []string{at("/ip6/%s/tcp/0")}, 0},
+		{"relay", []string{at("/ip6/%s/tcp/5000/ipfs/QmQnAZsyiJSovuqg8zjP3nKdm6Pwb75Mpn8HnGyD5WYZ15/p2p-circuit")}, 0},
+		{"bounded", many, maxRegisterAddrs},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs := make([]ma.Multiaddr, 0, len(tc.announced))
+			for _, a := range tc.announced {
+				addrs = append(addrs, mustAddr(t, a))
+			}
+			if got := sn.registrableAddrs(c.host.ID(), addrs); len(got) != tc.want {
+				t.Fatalf("registered %v, want %d addresses", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidMapping(t *testing.T) {
+	cases := []struct {
+		ip   string
+		port int
+		ok   bool
+	}{
+		{"203.0.113.7", 4001, true},
+		{"2001:db8::1", 4001, true},
+		{"", 4001, false},
+		{"0.0.0.0", 4001, false},
+		{"10.0.0.1", 4001, false},
+		{"172.16.0.1", 4001, false},
+		{"100.64.0.1", 4001, false},
+		{"169.254.0.1", 4001, false},
+		{"fd00::1", 4001, false},
+		{"203.0.113.7", 0, false},
+		{"203.0.113.7", 70000, false},
+	}
+	for _, c := range cases {
+		err := validMapping(net.ParseIP(c.ip), c.port)
+		if (err == nil) != c.ok {
+			t.Errorf("%s:%d: got %v, want ok %v", c.ip, c.port, err, c.ok)
+		}
+	}
+}
@@ -26,18 +26,33 @@ const (
 	Protocol_CONNECTION_REQUEST Protocol_Type = 0
 	Protocol_HOLE_PUNCH_REQUEST Protocol_Type = 1
 	Protocol_PEER_UNKNOWN       Protocol_Type = 3
+	Protocol_PUNCH_RESULT       Protocol_Type = 4
+	Protocol_ERROR              Protocol_Type = 5
+	// REGISTER announces extra addresses of a client, e.g. mapped ports
+	Protocol_REGISTER Protocol_Type = 6
+	// NAT_PROBE asks a service node for the address it observes the
+	// sender at, the answer carries it in peerInfo.observed
+	Protocol_NAT_PROBE Protocol_Type = 7
 )
 
 var Protocol_Type_name = map[int32]string{
 	0: "CONNECTION_REQUEST",
 	1: "HOLE_PUNCH_REQUEST",
 	3: "PEER_UNKNOWN",
+	4: "PUNCH_RESULT",
+	5: "ERROR",
+	6: "REGISTER",
+	7: "NAT_PROBE",
 }
 
 var Protocol_Type_value = map[string]int32{
 	"CONNECTION_REQUEST": 0,
 	"HOLE_PUNCH_REQUEST": 1,
 	"PEER_UNKNOWN":       3,
+	"PUNCH_RESULT":       4,
+	"ERROR":              5,
+	"REGISTER":           6,
+	"NAT_PROBE":          7,
 }
 
 func (x Protocol_Type) String() string {
@@ -49,12 +64,14 @@ func (Protocol_Type) EnumDescriptor() ([]byte, []int) {
 }
 
 type Protocol struct {
-	Type                 Protocol_Type      `protobuf:"varint,1,opt,name=type,proto3,enum=protocol.Protocol_Type" json:"type,omitempty"`
-	PeerID               *Protocol_PeerID   `protobuf:"bytes,2,opt,name=peerID,proto3" json:"peerID,omitempty"`
-	PeerInfo             *Protocol_PeerInfo `protobuf:"bytes,3,opt,name=peerInfo,proto3" json:"peerInfo,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
-	XXX_unrecognized     []byte             `json:"-"`
-	XXX_sizecache        int32              `json:"-"`
+	Type                 Protocol_Type         `protobuf:"varint,1,opt,name=type,proto3,enum=protocol.Protocol_Type" json:"type,omitempty"`
+	PeerID               *Protocol_PeerID      `protobuf:"bytes,2,opt,name=peerID,proto3" json:"peerID,omitempty"`
+	PeerInfo             *Protocol_PeerInfo    `protobuf:"bytes,3,opt,name=peerInfo,proto3" json:"peerInfo,omitempty"`
+	PunchResult          *Protocol_PunchResult `protobuf:"bytes,4,opt,name=punchResult,proto3" json:"punchResult,omitempty"`
+	Error                *Protocol_Error       `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}              `json:"-"`
+	XXX_unrecognized     []byte                `json:"-"`
+	XXX_sizecache        int32                 `json:"-"`
 }
 
 func (m *Protocol) Reset()         { *m = Protocol{} }
@@ -103,6 +120,20 @@ func (m *Protocol) GetPeerInfo() *Protocol_PeerInfo {
 	return nil
 }
 
+func (m *Protocol) GetPunchResult() *Protocol_PunchResult {
+	if m != nil {
+		return m.PunchResult
+	}
+	return nil
+}
+
+func (m *Protocol) GetError() *Protocol_Error {
+	if m != nil {
+		return m.Error
+	}
+	return nil
+}
+
 type Protocol_PeerID struct {
 	Id                   []byte   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -143,7 +174,12 @@ func (m *Protocol_PeerID) GetId() []byte {
 }
 
 type Protocol_PeerInfo struct {
-	Info                 []byte   `protobuf:"bytes,1,opt,name=info,proto3" json:"info,omitempty"`
+	Info []byte `protobuf:"bytes,1,opt,name=info,proto3" json:"info,omitempty"`
+	// binary multiaddrs the service node observed the peer connecting from
+	Observed [][]byte `protobuf:"bytes,2,rep,name=observed,proto3" json:"observed,omitempty"`
+	// traversal strategies in the order the service node suggests
+	// trying them, ranked by the punches reported to it
+	Strategies           []string `protobuf:"bytes,3,rep,name=strategies,proto3" json:"strategies,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -181,30 +217,210 @@ func (m *Protocol_PeerInfo) GetInfo() []byte {
 	return nil
 }
 
+func (m *Protocol_PeerInfo) GetObserved() [][]byte {
+	if m != nil {
+		return m.Observed
+	}
+	return nil
+}
+
+func (m *Protocol_PeerInfo) GetStrategies() []string {
+	if m != nil {
+		return m.Strategies
+	}
+	return nil
+}
+
+// PunchResult is sent by each side of a punch to the service node
+// which coordinated it.
+type Protocol_PunchResult struct {
+	Success bool `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	// hex encoded ID of the peer punched to
+	PeerID []byte `protobuf:"bytes,2,opt,name=peerID,proto3" json:"peerID,omitempty"`
+	// binary multiaddr of the established connection
+	Addr      []byte `protobuf:"bytes,3,opt,name=addr,proto3" json:"addr,omitempty"`
+	Transport string `protobuf:"bytes,4,opt,name=transport,proto3" json:"transport,omitempty"`
+	ElapsedMs int64  `protobuf:"varint,5,opt,name=elapsedMs,proto3" json:"elapsedMs,omitempty"`
+	Attempts  int32  `protobuf:"varint,6,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	Error     string `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
+	// NAT type of the reporting peer, as detected by itself
+	NatType string `protobuf:"bytes,8,opt,name=natType,proto3" json:"natType,omitempty"`
+	// traversal strategy which established the connection
+	Strategy             string   `protobuf:"bytes,9,opt,name=strategy,proto3" json:"strategy,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Protocol_PunchResult) Reset()         { *m = Protocol_PunchResult{} }
+func (m *Protocol_PunchResult) String() string { return proto.CompactTextString(m) }
+func (*Protocol_PunchResult) ProtoMessage()    {}
+func (*Protocol_PunchResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{0, 2}
+}
+
+func (m *Protocol_PunchResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Protocol_PunchResult.Unmarshal(m, b)
+}
+func (m *Protocol_PunchResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Protocol_PunchResult.Marshal(b, m, deterministic)
+}
+func (m *Protocol_PunchResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Protocol_PunchResult.Merge(m, src)
+}
+func (m *Protocol_PunchResult) XXX_Size() int {
+	return xxx_messageInfo_Protocol_PunchResult.Size(m)
+}
+func (m *Protocol_PunchResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_Protocol_PunchResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Protocol_PunchResult proto.InternalMessageInfo
+
+func (m *Protocol_PunchResult) GetSuccess() bool {
+	if m != nil {
+		return m.Success
+	}
+	return false
+}
+
+func (m *Protocol_PunchResult) GetPeerID() []byte {
+	if m != nil {
+		return m.PeerID
+	}
+	return nil
+}
+
+func (m *Protocol_PunchResult) GetAddr() []byte {
+	if m != nil {
+		return m.Addr
+	}
+	return nil
+}
+
+func (m *Protocol_PunchResult) GetTransport() string {
+	if m != nil {
+		return m.Transport
+	}
+	return ""
+}
+
+func (m *Protocol_PunchResult) GetElapsedMs() int64 {
+	if m != nil {
+		return m.ElapsedMs
+	}
+	return 0
+}
+
+func (m *Protocol_PunchResult) GetAttempts() int32 {
+	if m != nil {
+		return m.Attempts
+	}
+	return 0
+}
+
+func (m *Protocol_PunchResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *Protocol_PunchResult) GetNatType() string {
+	if m != nil {
+		return m.NatType
+	}
+	return ""
+}
+
+func (m *Protocol_PunchResult) GetStrategy() string {
+	if m != nil {
+		return m.Strategy
+	}
+	return ""
+}
+
+// Error tells a peer that its message could not be handled.
+type Protocol_Error struct {
+	Message              string   `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Protocol_Error) Reset()         { *m = Protocol_Error{} }
+func (m *Protocol_Error) String() string { return proto.CompactTextString(m) }
+func (*Protocol_Error) ProtoMessage()    {}
+func (*Protocol_Error) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{0, 3}
+}
+
+func (m *Protocol_Error) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Protocol_Error.Unmarshal(m, b)
+}
+func (m *Protocol_Error) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Protocol_Error.Marshal(b, m, deterministic)
+}
+func (m *Protocol_Error) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Protocol_Error.Merge(m, src)
+}
+func (m *Protocol_Error) XXX_Size() int {
+	return xxx_messageInfo_Protocol_Error.Size(m)
+}
+func (m *Protocol_Error) XXX_DiscardUnknown() {
+	xxx_messageInfo_Protocol_Error.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Protocol_Error proto.InternalMessageInfo
+
+func (m *Protocol_Error) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("protocol.Protocol_Type", Protocol_Type_name, Protocol_Type_value)
 	proto.RegisterType((*Protocol)(nil), "protocol.Protocol")
 	proto.RegisterType((*Protocol_PeerID)(nil), "protocol.Protocol.PeerID")
 	proto.RegisterType((*Protocol_PeerInfo)(nil), "protocol.Protocol.PeerInfo")
+	proto.RegisterType((*Protocol_PunchResult)(nil), "protocol.Protocol.PunchResult")
+	proto.RegisterType((*Protocol_Error)(nil), "protocol.Protocol.Error")
 }
 
 func init() { proto.RegisterFile("protocol.proto", fileDescriptor_2bc2336598a3f7e0) }
 
 var fileDescriptor_2bc2336598a3f7e0 = []byte{
-	// 230 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2b, 0x28, 0xca, 0x2f,
-	0xc9, 0x4f, 0xce, 0xcf, 0xd1, 0x03, 0x33, 0x84, 0x38, 0x60, 0x7c, 0xa5, 0xe5, 0x4c, 0x5c, 0x1c,
-	0x01, 0x50, 0x8e, 0x90, 0x36, 0x17, 0x4b, 0x49, 0x65, 0x41, 0xaa, 0x04, 0xa3, 0x02, 0xa3, 0x06,
-	0x9f, 0x91, 0xb8, 0x1e, 0x5c, 0x17, 0x4c, 0x85, 0x5e, 0x48, 0x65, 0x41, 0x6a, 0x10, 0x58, 0x91,
-	0x90, 0x21, 0x17, 0x5b, 0x41, 0x6a, 0x6a, 0x91, 0xa7, 0x8b, 0x04, 0x93, 0x02, 0xa3, 0x06, 0xb7,
-	0x91, 0x24, 0x16, 0xe5, 0x01, 0x60, 0x05, 0x41, 0x50, 0x85, 0x42, 0xe6, 0x5c, 0x1c, 0x60, 0x56,
-	0x5e, 0x5a, 0xbe, 0x04, 0x33, 0x58, 0x93, 0x34, 0x2e, 0x4d, 0x79, 0x69, 0xf9, 0x41, 0x70, 0xc5,
-	0x52, 0x12, 0x5c, 0x6c, 0x10, 0xa3, 0x84, 0xf8, 0xb8, 0x98, 0x32, 0x53, 0xc0, 0x0e, 0xe4, 0x09,
-	0x62, 0xca, 0x4c, 0x91, 0x92, 0xe3, 0xe2, 0x80, 0xa9, 0x17, 0x12, 0xe2, 0x62, 0xc9, 0x04, 0x19,
-	0x0d, 0x91, 0x05, 0xb3, 0x95, 0x3c, 0xb8, 0x58, 0x40, 0x6e, 0x16, 0x12, 0xe3, 0x12, 0x72, 0xf6,
-	0xf7, 0xf3, 0x73, 0x75, 0x0e, 0xf1, 0xf4, 0xf7, 0x8b, 0x0f, 0x72, 0x0d, 0x0c, 0x75, 0x0d, 0x0e,
-	0x11, 0x60, 0x00, 0x89, 0x7b, 0xf8, 0xfb, 0xb8, 0xc6, 0x07, 0x84, 0xfa, 0x39, 0x7b, 0xc0, 0xc5,
-	0x19, 0x85, 0x04, 0xb8, 0x78, 0x02, 0x5c, 0x5d, 0x83, 0xe2, 0x43, 0xfd, 0xbc, 0xfd, 0xfc, 0xc3,
-	0xfd, 0x04, 0x98, 0x93, 0xd8, 0xc0, 0x2e, 0x35, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0x23, 0xdd,
-	0xb0, 0x9a, 0x4c, 0x01, 0x00, 0x00,
+	// 474 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x52, 0xdf, 0x8b, 0xd3, 0x40,
+	0x10, 0x36, 0xcd, 0x8f, 0x4b, 0xa6, 0xb1, 0x84, 0x41, 0xce, 0xb5, 0xca, 0x51, 0xef, 0xa9, 0x20,
+	0x14, 0x3c, 0x1f, 0x7c, 0x55, 0xeb, 0xe2, 0x15, 0xcf, 0xa4, 0x4e, 0x53, 0x04, 0x5f, 0x4a, 0xae,
+	0xd9, 0x3b, 0x0b, 0xbd, 0x26, 0xec, 0x6e, 0x85, 0xbe, 0xfa, 0xff, 0xf8, 0xf7, 0xf9, 0x2a, 0xd9,
+	0x34, 0x69, 0x85, 0xfa, 0x36, 0xdf, 0x37, 0xdf, 0xb7, 0x3b, 0xf3, 0x31, 0xd0, 0x2b, 0x65, 0xa1,
+	0x8b, 0x65, 0xb1, 0x1e, 0x99, 0x02, 0xfd, 0x06, 0x5f, 0xfe, 0xf6, 0xc0, 0x9f, 0xee, 0x01, 0xbe,
+	0x02, 0x47, 0xef, 0x4a, 0xc1, 0xac, 0x81, 0x35, 0xec, 0x5d, 0x3d, 0x1d, 0xb5, 0xae, 0x46, 0x31,
+	0x4a, 0x77, 0xa5, 0x20, 0x23, 0xc2, 0xd7, 0xe0, 0x95, 0x42, 0xc8, 0xc9, 0x47, 0xd6, 0x19, 0x58,
+	0xc3, 0xee, 0xd5, 0xb3, 0x13, 0xf2, 0xa9, 0x11, 0xd0, 0x5e, 0x88, 0x6f, 0xc1, 0x37, 0xd5, 0xe6,
+	0xae, 0x60, 0xb6, 0x31, 0x3d, 0xff, 0x9f, 0x69, 0x73, 0x57, 0x50, 0x2b, 0xc6, 0x77, 0xd0, 0x2d,
+	0xb7, 0x9b, 0xe5, 0x0f, 0x12, 0x6a, 0xbb, 0xd6, 0xcc, 0x31, 0xde, 0x8b, 0x53, 0xde, 0x83, 0x8a,
+	0x8e, 0x2d, 0x38, 0x02, 0x57, 0x48, 0x59, 0x48, 0xe6, 0x1a, 0x2f, 0x3b, 0xe1, 0xe5, 0x55, 0x9f,
+	0x6a, 0x59, 0x9f, 0x81, 0x57, 0x0f, 0x8f, 0x3d, 0xe8, 0xac, 0x72, 0x13, 0x49, 0x48, 0x9d, 0x55,
+	0xde, 0xff, 0x0e, 0x7e, 0x33, 0x21, 0x22, 0x38, 0xab, 0x6a, 0x99, 0xba, 0x6b, 0x6a, 0xec, 0x83,
+	0x5f, 0xdc, 0x2a, 0x21, 0x7f, 0x8a, 0x9c, 0x75, 0x06, 0xf6, 0x30, 0xa4, 0x16, 0xe3, 0x05, 0x80,
+	0xd2, 0x32, 0xd3, 0xe2, 0x7e, 0x25, 0x14, 0xb3, 0x07, 0xf6, 0x30, 0xa0, 0x23, 0xa6, 0xff, 0xc7,
+	0x82, 0xee, 0xd1, 0x0a, 0xc8, 0xe0, 0x4c, 0x6d, 0x97, 0x4b, 0xa1, 0x94, 0xf9, 0xc2, 0xa7, 0x06,
+	0xe2, 0xf9, 0x3f, 0xe9, 0x87, 0x6d, 0xc4, 0x08, 0x4e, 0x96, 0xe7, 0xd2, 0xc4, 0x1b, 0x92, 0xa9,
+	0xf1, 0x05, 0x04, 0x5a, 0x66, 0x1b, 0x55, 0x16, 0xb2, 0xce, 0x2e, 0xa0, 0x03, 0x51, 0x75, 0xc5,
+	0x3a, 0x2b, 0x95, 0xc8, 0xbf, 0x28, 0x93, 0x8e, 0x4d, 0x07, 0xa2, 0xda, 0x26, 0xd3, 0x5a, 0x3c,
+	0x94, 0x5a, 0x31, 0x6f, 0x60, 0x0d, 0x5d, 0x6a, 0x31, 0x3e, 0x69, 0x32, 0x3d, 0x33, 0x6f, 0xd6,
+	0xa0, 0x9a, 0x79, 0x93, 0xe9, 0xea, 0x50, 0x98, 0x6f, 0xf8, 0x06, 0x56, 0x6f, 0xed, 0x77, 0xdd,
+	0xb1, 0xc0, 0xb4, 0x5a, 0xdc, 0x7f, 0x09, 0x2e, 0x6f, 0xec, 0x0f, 0x42, 0xa9, 0xec, 0xbe, 0x3e,
+	0xc3, 0x80, 0x1a, 0x78, 0xf9, 0xcb, 0x02, 0xc7, 0xbc, 0x73, 0x0e, 0x38, 0x4e, 0xe2, 0x98, 0x8f,
+	0xd3, 0x49, 0x12, 0x2f, 0x88, 0x7f, 0x9d, 0xf3, 0x59, 0x1a, 0x3d, 0xaa, 0xf8, 0xeb, 0xe4, 0x86,
+	0x2f, 0xa6, 0xf3, 0x78, 0x7c, 0xdd, 0xf2, 0x16, 0x46, 0x10, 0x4e, 0x39, 0xa7, 0xc5, 0x3c, 0xfe,
+	0x1c, 0x27, 0xdf, 0xe2, 0xc8, 0x36, 0xcc, 0x5e, 0x34, 0x9b, 0xdf, 0xa4, 0x91, 0x83, 0x01, 0xb8,
+	0x9c, 0x28, 0xa1, 0xc8, 0xc5, 0x10, 0x7c, 0xe2, 0x9f, 0x26, 0xb3, 0x94, 0x53, 0xe4, 0xe1, 0x63,
+	0x08, 0xe2, 0xf7, 0xe9, 0x62, 0x4a, 0xc9, 0x07, 0x1e, 0x9d, 0xdd, 0x7a, 0xe6, 0x6e, 0xde, 0xfc,
+	0x1d, 0x00, 0xfb, 0x74, 0xa9, 0xb2, 0x52, 0x03, 0x00, 0x00,
 }
@@ -0,0 +1,49 @@
+package ntraversal
+
+import (
+	"context"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Punch connects to p with the help of a service node and blocks until
+// the punch finished or ctx is done. Failures are returned as *PunchError.
+// A retry policy set on ctx with WithRetryPolicy is used for the dials of
+// this punch.
+//
+// Concurrent punches to the same peer are joined: the punch runs once,
+// with the retry policy of the first caller, and is abandoned once the
+// contexts of all callers are done.
+func (b *NatTraversal) Punch(ctx context.Context, p peer.ID) (*PunchResult, error) {
+	pp, err := b.requestPunch(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-pp.done:
+	case <-ctx.Done():
+		if !b.leavePunch(p, pp, ctx.Err()) {
+			return nil, &PunchError{Result: pp.trace.result(), Err: ctx.Err()}
+		}
+		<-pp.done
+	}
+	if pp.err != nil {
+		return nil, pp.err
+	}
+	return pp.result, nil
+}
+
+// punchedConn returns a connection to p, preferring direct connections
+// over relayed ones.
+func (b *NatTraversal) punchedConn(p peer.ID) inet.Conn {
+	var relayed inet.Conn
+	for _, c := range b.host.Network().ConnsToPeer(p) {
+		if !isRelayAddr(c.RemoteMultiaddr()) {
+			return c
+		}
+		relayed = c
+	}
+	return relayed
+}
@@ -0,0 +1,60 @@
+package ntraversal
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	rate "golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long an unused per peer limiter is kept.
+const limiterIdleTimeout = 10 * time.Minute
+
+type peerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter limits the connection requests of every peer to a service
+// node with a token bucket.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mux    sync.Mutex
+	peers  map[peer.ID]*peerLimiter
+	lastGC time.Time
+}
+
+func newRateLimiter(perSec float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:  rate.Limit(perSec),
+		burst:  burst,
+		peers:  make(map[peer.ID]*peerLimiter),
+		lastGC: time.Now(),
+	}
+}
+
+func (rl *rateLimiter) allow(p peer.ID) bool {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastGC) > limiterIdleTimeout {
+		for id, pl := range rl.peers {
+			if now.Sub(pl.lastSeen) > limiterIdleTimeout {
+				delete(rl.peers, id)
+			}
+		}
+		rl.lastGC = now
+	}
+
+	pl, ok := rl.peers[p]
+	if !ok {
+		pl = &peerLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.peers[p] = pl
+	}
+	pl.lastSeen = now
+	return pl.limiter.AllowN(now, 1)
+}
@@ -0,0 +1,260 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ggio "github.com/gogo/protobuf/io"
+	circuit "github.com/libp2p/go-libp2p-circuit"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+const (
+	protocolUpgrade = "/ntraversal/upgrade/1.0.0"
+
+	upgradeTimeout = time.Minute
+	// exchangeTimeout bounds the exchange of peer infos which starts an
+	// upgrade.
+	exchangeTimeout = 10 * time.Second
+	// upgradeBackoff is how long we wait before trying to upgrade a
+	// relayed connection again after a failed punch.
+	upgradeBackoff = 10 * time.Minute
+)
+
+func isRelayAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(circuit.P_CIRCUIT)
+	return err == nil
+}
+
+// errNoDirectConn is returned when a dial connected, but only through a
+// relay.
+var errNoDirectConn = fmt.Errorf("no direct connection")
+
+// directConn returns a connection to p which is not relayed, or nil.
+func (b *NatTraversal) directConn(p peer.ID) inet.Conn {
+	for _, c := range b.host.Network().ConnsToPeer(p) {
+		if !isRelayAddr(c.RemoteMultiaddr()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// relayWatcher upgrades relayed connections to direct ones. The peer with
+// the smaller ID starts the upgrade, so only one side does it.
+type relayWatcher struct {
+	b *NatTraversal
+
+	mux      sync.Mutex
+	inFlight map[peer.ID]struct{}
+	failed   map[peer.ID]time.Time
+}
+
+func newRelayWatcher(b *NatTraversal) *relayWatcher {
+	return &relayWatcher{
+		b:        b,
+		inFlight: make(map[peer.ID]struct{}),
+		failed:   make(map[peer.ID]time.Time),
+	}
+}
+
+func (rw *relayWatcher) Connected(n inet.Network, c inet.Conn) {
+	if !isRelayAddr(c.RemoteMultiaddr()) || c.LocalPeer() >= c.RemotePeer() {
+		return
+	}
+
+	p := c.RemotePeer()
+	for _, other := range n.ConnsToPeer(p) {
+		if !isRelayAddr(other.RemoteMultiaddr()) {
+			return
+		}
+	}
+
+	rw.mux.Lock()
+	if _, ok := rw.inFlight[p]; ok {
+		rw.mux.Unlock()
+		return
+	}
+	if t, ok := rw.failed[p]; ok && time.Since(t) < upgradeBackoff {
+		rw.mux.Unlock()
+		return
+	}
+	rw.inFlight[p] = struct{}{}
+	rw.mux.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(rw.b.ctx, upgradeTimeout)
+		defer cancel()
+
+		err := rw.b.upgradeRelayed(ctx, c)
+
+		rw.mux.Lock()
+		delete(rw.inFlight, p)
+		if err != nil {
+			log.Error("upgrading relayed connection to ", p, " failed: ", err)
+			rw.failed[p] = time.Now()
+		} else {
+			delete(rw.failed, p)
+		}
+		rw.mux.Unlock()
+	}()
+}
+
+func (rw *relayWatcher) Disconnected(n inet.Network, c inet.Conn)   {}
+func (rw *relayWatcher) OpenedStream(n inet.Network, s inet.Stream) {}
+func (rw *relayWatcher) ClosedStream(n inet.Network, s inet.Stream) {}
+func (rw *relayWatcher) Listen(n inet.Network, a ma.Multiaddr)      {}
+func (rw *relayWatcher) ListenClose(n inet.Network, a ma.Multiaddr) {}
+
+// ownPeerInfo encodes the public addresses of this node like findPeerInfo
+// does for the peers a service node looks up.
+func (b *NatTraversal) ownPeerInfo() ([]byte, error) {
+	pi := pstore.PeerInfo{
+		ID:    b.host.ID(),
+		Addrs: publicAddrs(b.host.Addrs()),
+	}
+	return pi.MarshalJSON()
+}
+
+// exchangePeerInfo sends our peer info to the remote peer of s and reads
+// its own, failing if the exchange is not done by deadline.
+func (b *NatTraversal) exchangePeerInfo(s inet.Stream, initiator bool, deadline time.Time) (pstore.PeerInfo, error) {
+	if err := s.SetDeadline(deadline); err != nil {
+		// Not all streams support deadlines, e.g. those of mocknet.
+		log.Debug("no deadline for upgrade stream to ", s.Conn().RemotePeer(), ": ", err)
+	}
+
+	r := ggio.NewDelimitedReader(s, b.cfg.maxMsgSize)
+	w := ggio.NewDelimitedWriter(s)
+
+	var pi pstore.PeerInfo
+
+	own, err := b.ownPeerInfo()
+	if err != nil {
+		return pi, err
+	}
+	req := &protocol.Protocol{
+		Type:     protocol.Protocol_HOLE_PUNCH_REQUEST,
+		PeerInfo: &protocol.Protocol_PeerInfo{Info: own},
+	}
+
+	if initiator {
+		if err := w.WriteMsg(req); err != nil {
+			return pi, err
+		}
+	}
+
+	res := &protocol.Protocol{}
+	if err := r.ReadMsg(res); err != nil {
+		return pi, err
+	}
+	if err := validatePacket(res); err != nil {
+		return pi, err
+	}
+	if res.Type != protocol.Protocol_HOLE_PUNCH_REQUEST {
+		return pi, fmt.Errorf("unexpected %s during upgrade", res.Type)
+	}
+	if err := pi.UnmarshalJSON(res.PeerInfo.Info); err != nil {
+		return pi, err
+	}
+	if pi.ID != s.Conn().RemotePeer() {
+		return pi, fmt.Errorf("peer info for %s received from %s", pi.ID, s.Conn().RemotePeer())
+	}
+
+	if !initiator {
+		if err := w.WriteMsg(req); err != nil {
+			return pi, err
+		}
+	}
+	return pi, nil
+}
+
+// upgradeRelayed coordinates a punch with the peer of a relayed
+// connection over the connection itself.
+func (b *NatTraversal) upgradeRelayed(ctx context.Context, c inet.Conn) error {
+	p := c.RemotePeer()
+	log.Info("Upgrading relayed connection to: ", p)
+
+	// The relayed connection is the only one to p, so the stream uses it.
+	s, err := b.host.NewStream(ctx, p, protocolUpgrade)
+	if err != nil {
+		return err
+	}
+
+	b.events.emit(Event{Type: EvtPunchRequested, Peer: p})
+
+	deadline := time.Now().Add(exchangeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	pi, err := b.exchangePeerInfo(s, true, deadline)
+	s.Close()
+	if err != nil {
+		return err
+	}
+	return b.migrate(ctx, c, pi)
+}
+
+// upgradeHandler answers the upgrade of a relayed connection. Upgrades
+// over other connections are refused, they would make us dial addresses of
+// the peer's choosing and close the connection they came over.
+func (b *NatTraversal) upgradeHandler(s inet.Stream) {
+	c := s.Conn()
+	if !isRelayAddr(c.RemoteMultiaddr()) {
+		log.Info("Refusing upgrade of a connection which is not relayed from: ", c.RemotePeer())
+		s.Reset()
+		return
+	}
+
+	pi, err := b.exchangePeerInfo(s, false, time.Now().Add(exchangeTimeout))
+	s.Close()
+	if err != nil {
+		log.Error("upgrade request from ", c.RemotePeer(), " failed: ", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, upgradeTimeout)
+	defer cancel()
+
+	if err := b.migrate(ctx, c, pi); err != nil {
+		log.Error("upgrading relayed connection to ", c.RemotePeer(), " failed: ", err)
+	}
+}
+
+// migrate punches a direct connection to pi while both sides dial at the
+// same time. The relayed connection stays open during the punch and is
+// only closed once a direct connection exists, so it keeps working if the
+// punch fails.
+func (b *NatTraversal) migrate(ctx context.Context, relayed inet.Conn, pi pstore.PeerInfo) error {
+	if !isRelayAddr(relayed.RemoteMultiaddr()) {
+		return fmt.Errorf("connection to %s is not relayed", pi.ID)
+	}
+	if len(pi.Addrs) == 0 {
+		return fmt.Errorf("peer %s has no public address", pi.ID)
+	}
+
+	b.events.emit(Event{Type: EvtPunchInstructionReceived, Peer: pi.ID, Addrs: pi.Addrs})
+
+	b.events.emit(Event{Type: EvtDialAttemptStarted, Peer: pi.ID, Attempt: 1, Addrs: pi.Addrs})
+	err := b.raceDial(ctx, pi, 1)
+	// The dial of the other side may have connected even if ours failed,
+	// and dials through the host may return the relayed connection.
+	if b.directConn(pi.ID) == nil {
+		if err == nil {
+			err = errNoDirectConn
+		}
+		b.events.emit(Event{Type: EvtDialAttemptFailed, Peer: pi.ID, Attempt: 1, Err: err})
+		b.events.emit(Event{Type: EvtRelayFallback, Peer: pi.ID, Err: err, Addrs: []ma.Multiaddr{relayed.RemoteMultiaddr()}})
+		return err
+	}
+
+	log.Info("Upgraded relayed connection to: ", pi.ID)
+	b.events.emit(Event{Type: EvtDirectConnEstablished, Peer: pi.ID, Attempt: 1})
+	return relayed.Close()
+}
@@ -0,0 +1,222 @@
+package ntraversal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+// relayedConn is a relayed connection which records being closed. If
+// direct is set it is a direct connection instead.
+type relayedConn struct {
+	inet.Conn
+	direct bool
+	closed bool
+}
+
+func (c *relayedConn) RemoteMultiaddr() ma.Multiaddr {
+	if c.direct {
+		return ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	}
+	return ma.StringCast(testRelayAddr)
+}
+
+func (c *relayedConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	cases := []struct {
+		name    string
+		dialer  AddrDialer
+		wantErr bool
+	}{
+		// The default dialer connects through the mock network.
+		{"punched", nil, false},
+		{"punch failed", &recordingDialer{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mn := mocknet.New(context.Background())
+			var opts []Option
+			if c.dialer != nil {
+				opts = append(opts, WithAddrDialer(c.dialer))
+			}
+			a := newTestTraversalOn(t, mn, nil, opts...)
+			b := newTestTraversalOn(t, mn, nil, opts...)
+			if _, err := mn.LinkPeers(a.host.ID(), b.host.ID()); err != nil {
+				t.Fatal(err)
+			}
+
+			// Both sides migrate, whichever ID is smaller.
+			for _, pair := range [][2]*NatTraversal{{a, b}, {b, a}} {
+				from, to := pair[0], pair[1]
+				relayed := &relayedConn{}
+				pi := pstore.PeerInfo{ID: to.host.ID(), Addrs: to.host.Addrs()}
+				err := from.migrate(context.Background(), relayed, pi)
+				if (err != nil) != c.wantErr {
+					t.Fatalf("got error %v, want error %v", err, c.wantErr)
+				}
+				if relayed.closed == c.wantErr {
+					t.Fatalf("relayed connection closed: %v, want %v", relayed.closed, !c.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeNeedsRelayedConn(t *testing.T) {
+	mn := mocknet.New(context.Background())
+	d := &recordingDialer{}
+	a := newTestTraversalOn(t, mn, nil, UpgradeRelayed)
+	b := newTestTraversalOn(t, mn, nil, UpgradeRelayed, WithAddrDialer(d))
+	if _, err := mn.LinkPeers(a.host.ID(), b.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// migrate keeps connections which are not relayed.
+	direct := &relayedConn{direct: true}
+	pi := pstore.PeerInfo{ID: a.host.ID(), Addrs: []ma.Multiaddr{mustAddr(t, "/ip4/1.2.3.4/tcp/4001")}}
+	if err := b.migrate(context.Background(), direct, pi); err == nil {
+		t.Fatal("migrated a direct connection")
+	}
+	if direct.closed {
+		t.Fatal("direct connection closed")
+	}
+
+	// The upgrade stream over the direct connection of the mock network
+	// is refused before the peer info is exchanged.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if s, err := a.host.NewStream(ctx, b.host.ID(), protocolUpgrade); err == nil {
+		defer s.Reset()
+		if _, err := a.exchangePeerInfo(s, true, time.Now().Add(5*time.Second)); err == nil {
+			t.Fatal("upgrade over a direct connection answered")
+		}
+	}
+	if len(d.dialed) != 0 {
+		t.Fatalf("dialed %v for an upgrade over a direct connection", d.dialed)
+	}
+	if len(b.host.Network().ConnsToPeer(a.host.ID())) == 0 {
+		t.Fatal("direct connection closed")
+	}
+}
+
+func TestExchangePeerInfoDeadline(t *testing.T) {
+	a := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+	b := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+
+	done := make(chan struct{})
+	defer close(done)
+	b.SetStreamHandler(protocolUpgrade, func(s inet.Stream) {
+		// Never send a peer info.
+		<-done
+		s.Reset()
+	})
+
+	nt, err := NewNatTraversal(context.Background(), a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nt.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.Peerstore().AddAddrs(b.ID(), b.Addrs(), time.Minute)
+	s, err := a.NewStream(ctx, b.ID(), protocolUpgrade)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+
+	start := time.Now()
+	if _, err := nt.exchangePeerInfo(s, false, time.Now().Add(100*time.Millisecond)); err == nil {
+		t.Fatal("exchange without a peer info succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("exchange gave up after %s", elapsed)
+	}
+}
+
+// relayFirstHost lists a relayed connection before the others of its
+// network.
+type relayFirstHost struct {
+	host.Host
+	net relayFirstNetwork
+}
+
+func (h relayFirstHost) Network() inet.Network { return h.net }
+
+type relayFirstNetwork struct {
+	inet.Network
+	relayed inet.Conn
+}
+
+func (n relayFirstNetwork) ConnsToPeer(p peer.ID) []inet.Conn {
+	return append([]inet.Conn{n.relayed}, n.Network.ConnsToPeer(p)...)
+}
+
+func TestPunchResultNamesDirectConn(t *testing.T) {
+	mn := mocknet.New(context.Background())
+	ha, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ha.Close()
+	hb, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Close()
+	if _, err := mn.LinkPeers(ha.ID(), hb.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	h := relayFirstHost{ha, relayFirstNetwork{ha.Network(), &relayedConn{}}}
+	b, err := NewNatTraversal(context.Background(), h, nil, Pipeline(Stage{Strategy: DirectDial{}, Timeout: 5 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	sn := testPeer(t)
+	b.serviceNodes = []peer.ID{sn}
+
+	events, cancel := b.Subscribe()
+	defer cancel()
+
+	info, err := pstore.PeerInfo{ID: hb.ID(), Addrs: hb.Addrs()}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.handleHolePunchRequest(PacketWPeer{
+		peer: sn,
+		packet: &protocol.Protocol{
+			Type:     protocol.Protocol_HOLE_PUNCH_REQUEST,
+			PeerInfo: &protocol.Protocol_PeerInfo{Info: info},
+		},
+	})
+
+	for {
+		select {
+		case evt := <-events:
+			if evt.Type != EvtDirectConnEstablished {
+				continue
+			}
+			if len(evt.Addrs) != 1 || isRelayAddr(evt.Addrs[0]) {
+				t.Fatalf("direct connection at %v", evt.Addrs)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no direct connection established")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package ntraversal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// RetryPolicy decides how often and when the dials of a punch are
+// repeated. Both peers dial at about the same time, so short delays keep
+// their dials overlapping.
+type RetryPolicy struct {
+	// MaxAttempts is the number of dials, at least 1.
+	MaxAttempts int
+	// InitialDelay is the delay before the second dial.
+	InitialDelay time.Duration
+	// BackoffFactor multiplies the delay after every retry, 1 keeps it
+	// constant.
+	BackoffFactor float64
+	// MaxDelay caps the delay, 0 for no cap.
+	MaxDelay time.Duration
+	// Jitter randomizes the delay by up to this fraction in either
+	// direction, between 0 and 1.
+	Jitter float64
+	// AttemptTimeout bounds each dial, 0 for no bound besides the timeout
+	// of the stage.
+	AttemptTimeout time.Duration
+	// Classes overrides the behavior for the dial failure classes, such
+	// as ErrNoRoute. Failures of other classes are retried.
+	Classes map[error]ClassPolicy
+}
+
+// ClassPolicy is how a RetryPolicy handles failures of one class.
+type ClassPolicy struct {
+	// GiveUp stops dialing after a failure of the class.
+	GiveUp bool
+	// MinDelay raises the delay before the next dial.
+	MinDelay time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used unless the Retry option is
+// given. Dialing a peer with another identity or without usable addresses
+// again cannot succeed, nor can dialing a peer the host keeps backing off;
+// a peer without a route gets a second to bring its network up.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:   3,
+		InitialDelay:  100 * time.Millisecond,
+		BackoffFactor: 2,
+		MaxDelay:      2 * time.Second,
+		Jitter:        0.2,
+		Classes: map[error]ClassPolicy{
+			ErrPeerIDMismatch:   {GiveUp: true},
+			ErrAllAddrsFiltered: {GiveUp: true},
+			ErrDialBackoff:      {GiveUp: true},
+			ErrNoRoute:          {MinDelay: time.Second},
+		},
+	}
+}
+
+func (p RetryPolicy) validate() error {
+	switch {
+	case p.MaxAttempts < 1:
+		return fmt.Errorf("invalid retry attempts: %d", p.MaxAttempts)
+	case p.InitialDelay < 0 || p.MaxDelay < 0 || p.AttemptTimeout < 0:
+		return fmt.Errorf("negative retry delay or timeout")
+	case p.BackoffFactor < 1:
+		return fmt.Errorf("invalid retry backoff factor: %v", p.BackoffFactor)
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("invalid retry jitter: %v", p.Jitter)
+	}
+	return nil
+}
+
+// next decides after the failed dial number attempt (1-based) whether to
+// dial again and after which delay.
+func (p RetryPolicy) next(attempt int, err error) (bool, time.Duration) {
+	if attempt >= p.MaxAttempts {
+		return false, 0
+	}
+
+	delay := time.Duration(float64(p.InitialDelay) * math.Pow(p.BackoffFactor, float64(attempt-1)))
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 && delay > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+
+	for class, cp := range p.Classes {
+		if !errors.Is(err, class) {
+			continue
+		}
+		if cp.GiveUp {
+			return false, 0
+		}
+		if delay < cp.MinDelay {
+			delay = cp.MinDelay
+		}
+	}
+	return true, delay
+}
+
+type retryKey struct{}
+
+// WithRetryPolicy returns a context making punches started with it, e.g.
+// through Punch, use p instead of the configured policy.
+func WithRetryPolicy(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryKey{}, p)
+}
+
+// retryPolicy returns the policy of ctx or the configured one.
+func (b *NatTraversal) retryPolicy(ctx context.Context) RetryPolicy {
+	if p, ok := ctx.Value(retryKey{}).(RetryPolicy); ok {
+		return p
+	}
+	return b.cfg.retry
+}
+
+// dialRepeatedly dials pi following the retry policy of ctx. attempts
+// overrides the number of dials of the policy if positive.
+func dialRepeatedly(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo, attempts int) error {
+	policy := nt.retryPolicy(ctx)
+	if attempts > 0 {
+		policy.MaxAttempts = attempts
+	}
+
+	var err error
+	for i := 1; ; i++ {
+		err = dialAttempt(ctx, nt, pi, policy.AttemptTimeout)
+		if err == nil {
+			log.Infof("Dial attempt %d to %s succeeded", i, pi.ID.Pretty())
+			return nil
+		}
+		log.Errorf("Dial attempt %d to %s failed: %s", i, pi.ID.Pretty(), err)
+
+		retry, delay := policy.next(i, err)
+		if !retry {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func dialAttempt(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return nt.Dial(ctx, pi)
+}
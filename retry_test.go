@@ -0,0 +1,151 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func TestRetryPolicyValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(*RetryPolicy)
+		valid  bool
+	}{
+		{"default", func(*RetryPolicy) {}, true},
+		{"single attempt", func(p *RetryPolicy) { p.MaxAttempts = 1 }, true},
+		{"no attempts", func(p *RetryPolicy) { p.MaxAttempts = 0 }, false},
+		{"negative initial delay", func(p *RetryPolicy) { p.InitialDelay = -1 }, false},
+		{"negative max delay", func(p *RetryPolicy) { p.MaxDelay = -1 }, false},
+		{"negative attempt timeout", func(p *RetryPolicy) { p.AttemptTimeout = -1 }, false},
+		{"constant delay", func(p *RetryPolicy) { p.BackoffFactor = 1 }, true},
+		{"shrinking delay", func(p *RetryPolicy) { p.BackoffFactor = 0.5 }, false},
+		{"no jitter", func(p *RetryPolicy) { p.Jitter = 0 }, true},
+		{"full jitter", func(p *RetryPolicy) { p.Jitter = 1 }, true},
+		{"negative jitter", func(p *RetryPolicy) { p.Jitter = -0.1 }, false},
+		{"jitter above 1", func(p *RetryPolicy) { p.Jitter = 1.1 }, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := DefaultRetryPolicy()
+			c.change(&p)
+			if err := p.validate(); (err == nil) != c.valid {
+				t.Fatalf("validate returned %v, want valid %v", err, c.valid)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	refused := newDialError(testPeer(t), nil, fmt.Errorf("connection refused"))
+	policy := RetryPolicy{
+		MaxAttempts:   5,
+		InitialDelay:  100 * time.Millisecond,
+		BackoffFactor: 2,
+		MaxDelay:      300 * time.Millisecond,
+		Classes: map[error]ClassPolicy{
+			ErrPeerIDMismatch: {GiveUp: true},
+			ErrNoRoute:        {MinDelay: time.Second},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		change   func(*RetryPolicy)
+		attempt  int
+		err      error
+		retry    bool
+		min, max time.Duration
+	}{
+		{"first retry", nil, 1, refused, true, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"backoff", nil, 2, refused, true, 200 * time.Millisecond, 200 * time.Millisecond},
+		{"capped", nil, 3, refused, true, 300 * time.Millisecond, 300 * time.Millisecond},
+		{"uncapped", func(p *RetryPolicy) { p.MaxDelay = 0 }, 3, refused, true, 400 * time.Millisecond, 400 * time.Millisecond},
+		{"constant", func(p *RetryPolicy) { p.BackoffFactor = 1 }, 3, refused, true, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"exhausted", nil, 5, refused, false, 0, 0},
+		{"beyond attempts", nil, 6, refused, false, 0, 0},
+		{"jitter", func(p *RetryPolicy) { p.Jitter = 0.5 }, 1, refused, true, 50 * time.Millisecond, 150 * time.Millisecond},
+		{"give up", nil, 1, ErrPeerIDMismatch, false, 0, 0},
+		{"give up wrapped", nil, 1, newDialError(testPeer(t), nil, fmt.Errorf("peer id mismatch")), false, 0, 0},
+		{"min delay", nil, 1, ErrNoRoute, true, time.Second, time.Second},
+		{"min delay below", func(p *RetryPolicy) { p.InitialDelay = 2 * time.Second; p.MaxDelay = 0 }, 1, ErrNoRoute, true, 2 * time.Second, 2 * time.Second},
+		{"unknown class", nil, 1, fmt.Errorf("something else"), true, 100 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := policy
+			if c.change != nil {
+				c.change(&p)
+			}
+			// Jitter is random, so draw several delays.
+			for i := 0; i < 100; i++ {
+				retry, delay := p.next(c.attempt, c.err)
+				if retry != c.retry {
+					t.Fatalf("retry %v, want %v", retry, c.retry)
+				}
+				if delay < c.min || delay > c.max {
+					t.Fatalf("delay %s, want between %s and %s", delay, c.min, c.max)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultRetryPolicyClasses(t *testing.T) {
+	cases := []struct {
+		err   error
+		retry bool
+	}{
+		{ErrConnRefused, true},
+		{ErrNoRoute, true},
+		{ErrPeerIDMismatch, false},
+		{ErrAllAddrsFiltered, false},
+		{ErrDialBackoff, false},
+	}
+	for _, c := range cases {
+		t.Run(c.err.Error(), func(t *testing.T) {
+			if retry, _ := DefaultRetryPolicy().next(1, c.err); retry != c.retry {
+				t.Fatalf("retry %v, want %v", retry, c.retry)
+			}
+		})
+	}
+}
+
+func TestDialRepeatedly(t *testing.T) {
+	const addr = "/ip4/1.2.3.4/tcp/4001"
+
+	policy := RetryPolicy{MaxAttempts: 3, BackoffFactor: 1}
+	giveUp := policy
+	giveUp.Classes = map[error]ClassPolicy{ErrConnRefused: {GiveUp: true}}
+
+	cases := []struct {
+		name     string
+		ctx      context.Context
+		attempts int
+		connect  bool
+		want     int
+	}{
+		{"configured policy", context.Background(), 0, false, 2},
+		{"context policy", WithRetryPolicy(context.Background(), policy), 0, false, 3},
+		{"attempts override", WithRetryPolicy(context.Background(), policy), 4, false, 4},
+		{"give up", WithRetryPolicy(context.Background(), giveUp), 0, false, 1},
+		{"success", WithRetryPolicy(context.Background(), policy), 0, true, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &recordingDialer{connect: map[string]bool{addr: c.connect}}
+			b := newTestTraversal(t, nil, WithAddrDialer(d), Retry(RetryPolicy{MaxAttempts: 2, BackoffFactor: 1}))
+
+			err := dialRepeatedly(c.ctx, b, pstore.PeerInfo{ID: testPeer(t), Addrs: mustAddrs(t, []string{addr})}, c.attempts)
+			if (err == nil) != c.connect {
+				t.Fatalf("dial returned %v, want success %v", err, c.connect)
+			}
+			if len(d.dialed) != c.want {
+				t.Fatalf("%d dials, want %d", len(d.dialed), c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	host "github.com/libp2p/go-libp2p-host"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// PeerRouter finds the addresses of a peer. A service node uses it to look
+// up both sides of a punch. *dht.IpfsDHT implements it.
+type PeerRouter interface {
+	FindPeer(ctx context.Context, p peer.ID) (pstore.PeerInfo, error)
+}
+
+// ErrPeerNotFound is returned by routers which do not know a peer.
+var ErrPeerNotFound = fmt.Errorf("peer not found")
+
+// StaticRouter resolves peers from a fixed set of peer infos. It is meant
+// for tests and private deployments where addresses are known upfront.
+type StaticRouter struct {
+	mux   sync.RWMutex
+	peers map[peer.ID]pstore.PeerInfo
+}
+
+// NewStaticRouter creates a router knowing the given peers.
+func NewStaticRouter(pis ...pstore.PeerInfo) *StaticRouter {
+	r := &StaticRouter{
+		peers: make(map[peer.ID]pstore.PeerInfo),
+	}
+	for _, pi := range pis {
+		r.peers[pi.ID] = pi
+	}
+	return r
+}
+
+// Add adds or replaces a peer.
+func (r *StaticRouter) Add(pi pstore.PeerInfo) {
+	r.mux.Lock()
+	r.peers[pi.ID] = pi
+	r.mux.Unlock()
+}
+
+// Remove forgets a peer.
+func (r *StaticRouter) Remove(p peer.ID) {
+	r.mux.Lock()
+	delete(r.peers, p)
+	r.mux.Unlock()
+}
+
+// FindPeer implements PeerRouter.
+func (r *StaticRouter) FindPeer(ctx context.Context, p peer.ID) (pstore.PeerInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return pstore.PeerInfo{}, err
+	}
+
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	pi, ok := r.peers[p]
+	if !ok {
+		return pstore.PeerInfo{}, ErrPeerNotFound
+	}
+	return pi, nil
+}
+
+// PeerstoreRouter resolves peers from the addresses a host already knows,
+// which includes every client connected to a service node.
+type PeerstoreRouter struct {
+	h host.Host
+}
+
+// NewPeerstoreRouter creates a router backed by the peerstore of h.
+func NewPeerstoreRouter(h host.Host) *PeerstoreRouter {
+	return &PeerstoreRouter{h: h}
+}
+
+// FindPeer implements PeerRouter.
+func (r *PeerstoreRouter) FindPeer(ctx context.Context, p peer.ID) (pstore.PeerInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return pstore.PeerInfo{}, err
+	}
+
+	pi := r.h.Peerstore().PeerInfo(p)
+	if len(pi.Addrs) == 0 {
+		return pstore.PeerInfo{}, ErrPeerNotFound
+	}
+	return pi, nil
+}
+
+// CompositeRouter queries routers in order and returns the first peer
+// info found.
+type CompositeRouter []PeerRouter
+
+// FindPeer implements PeerRouter.
+func (rs CompositeRouter) FindPeer(ctx context.Context, p peer.ID) (pstore.PeerInfo, error) {
+	err := ErrPeerNotFound
+	for _, r := range rs {
+		var pi pstore.PeerInfo
+		pi, err = r.FindPeer(ctx, p)
+		if err == nil {
+			return pi, nil
+		}
+		if ctx.Err() != nil {
+			return pstore.PeerInfo{}, ctx.Err()
+		}
+	}
+	return pstore.PeerInfo{}, err
+}
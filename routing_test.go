@@ -0,0 +1,161 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// countingRouter counts its lookups and answers them with pi or err. If
+// cancel is set it is called first, like a router whose lookup outlived
+// the context.
+type countingRouter struct {
+	pi     pstore.PeerInfo
+	err    error
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (r *countingRouter) FindPeer(ctx context.Context, p peer.ID) (pstore.PeerInfo, error) {
+	r.calls++
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.err != nil {
+		return pstore.PeerInfo{}, r.err
+	}
+	return r.pi, nil
+}
+
+func TestStaticRouter(t *testing.T) {
+	known := pstore.PeerInfo{ID: testPeer(t), Addrs: []ma.Multiaddr{mustAddr(t, "/ip4/1.2.3.4/tcp/4001")}}
+	removed := pstore.PeerInfo{ID: testPeer(t), Addrs: known.Addrs}
+	added := pstore.PeerInfo{ID: testPeer(t), Addrs: known.Addrs}
+
+	r := NewStaticRouter(known, removed)
+	r.Remove(removed.ID)
+	r.Add(added)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		name string
+		ctx  context.Context
+		p    peer.ID
+		want error
+	}{
+		{"hit", context.Background(), known.ID, nil},
+		{"added", context.Background(), added.ID, nil},
+		{"miss", context.Background(), testPeer(t), ErrPeerNotFound},
+		{"removed", context.Background(), removed.ID, ErrPeerNotFound},
+		{"cancelled", cancelled, known.ID, context.Canceled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pi, err := r.FindPeer(c.ctx, c.p)
+			if err != c.want {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+			if err == nil && (pi.ID != c.p || len(pi.Addrs) != 1) {
+				t.Fatalf("found %v", pi)
+			}
+		})
+	}
+}
+
+func TestPeerstoreRouter(t *testing.T) {
+	h, err := mocknet.New(context.Background()).GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	known := testPeer(t)
+	h.Peerstore().AddAddr(known, mustAddr(t, "/ip4/1.2.3.4/tcp/4001"), time.Hour)
+	r := NewPeerstoreRouter(h)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		name string
+		ctx  context.Context
+		p    peer.ID
+		want error
+	}{
+		{"hit", context.Background(), known, nil},
+		{"miss", context.Background(), testPeer(t), ErrPeerNotFound},
+		{"cancelled", cancelled, known, context.Canceled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pi, err := r.FindPeer(c.ctx, c.p)
+			if err != c.want {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+			if err == nil && (pi.ID != c.p || len(pi.Addrs) != 1) {
+				t.Fatalf("found %v", pi)
+			}
+		})
+	}
+}
+
+func TestCompositeRouter(t *testing.T) {
+	p := testPeer(t)
+	found := pstore.PeerInfo{ID: p, Addrs: []ma.Multiaddr{mustAddr(t, "/ip4/1.2.3.4/tcp/4001")}}
+	broken := fmt.Errorf("router broken")
+
+	cases := []struct {
+		name string
+		// routers are the results of the routers, nil for found.
+		routers []error
+		// cancel cancels the lookup during the first router.
+		cancel bool
+		want   error
+		// calls are the lookups done by each router.
+		calls []int
+	}{
+		{"none", nil, false, ErrPeerNotFound, nil},
+		{"hit", []error{nil, nil}, false, nil, []int{1, 0}},
+		{"miss", []error{ErrPeerNotFound, ErrPeerNotFound}, false, ErrPeerNotFound, []int{1, 1}},
+		{"falls through on error", []error{broken, nil}, false, nil, []int{1, 1}},
+		{"last error", []error{ErrPeerNotFound, broken}, false, broken, []int{1, 1}},
+		{"cancelled", []error{context.Canceled, nil}, true, context.Canceled, []int{1, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var rs CompositeRouter
+			var counters []*countingRouter
+			for i, err := range c.routers {
+				cr := &countingRouter{pi: found, err: err}
+				if c.cancel && i == 0 {
+					cr.cancel = cancel
+				}
+				counters = append(counters, cr)
+				rs = append(rs, cr)
+			}
+
+			pi, err := rs.FindPeer(ctx, p)
+			if err != c.want {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+			if err == nil && pi.ID != p {
+				t.Fatalf("found %v", pi)
+			}
+			for i, cr := range counters {
+				if cr.calls != c.calls[i] {
+					t.Errorf("router %d queried %d times, want %d", i, cr.calls, c.calls[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package ntraversal
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+// PunchOutcome counts reported punch results.
+type PunchOutcome struct {
+	Success int
+	Failure int
+}
+
+// SuccessRate returns the fraction of successful punches, or -1 if no punch
+// has been reported yet.
+func (o PunchOutcome) SuccessRate() float64 {
+	total := o.Success + o.Failure
+	if total == 0 {
+		return -1
+	}
+	return float64(o.Success) / float64(total)
+}
+
+// PunchStats aggregates the punch results reported to a service node by
+// its clients.
+type PunchStats struct {
+	// ByNATType is keyed by the NAT type reported by the client.
+	ByNATType map[string]PunchOutcome
+	// ByAddrFamily is keyed by "ip4", "ip6" or "unknown" for failed punches.
+	ByAddrFamily map[string]PunchOutcome
+	// ByStrategy counts the successful punches by the NAT type reported by
+	// the client and the strategy which connected.
+	ByStrategy map[string]map[string]int
+}
+
+type punchStats struct {
+	mux        sync.Mutex
+	byNAT      map[NATType]PunchOutcome
+	byFamily   map[string]PunchOutcome
+	byStrategy map[NATType]map[string]int
+}
+
+func newPunchStats() *punchStats {
+	return &punchStats{
+		byNAT:      make(map[NATType]PunchOutcome),
+		byFamily:   make(map[string]PunchOutcome),
+		byStrategy: make(map[NATType]map[string]int),
+	}
+}
+
+// record counts a punch result. strategy is empty for failed punches and
+// must be a strategy of the pipeline otherwise, so the keys are bounded.
+func (ps *punchStats) record(natType NATType, family, strategy string, success bool) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	o := ps.byNAT[natType]
+	f := ps.byFamily[family]
+	if success {
+		o.Success++
+		f.Success++
+	} else {
+		o.Failure++
+		f.Failure++
+	}
+	ps.byNAT[natType] = o
+	ps.byFamily[family] = f
+
+	if success && strategy != "" {
+		if ps.byStrategy[natType] == nil {
+			ps.byStrategy[natType] = make(map[string]int)
+		}
+		ps.byStrategy[natType][strategy]++
+	}
+}
+
+// rankStrategies orders names by the punches they established for peers
+// behind any of natTypes. Strategies which connected equally often keep
+// their order.
+func (ps *punchStats) rankStrategies(names []string, natTypes ...NATType) []string {
+	ps.mux.Lock()
+	score := make(map[string]int, len(names))
+	for _, t := range natTypes {
+		for _, n := range names {
+			score[n] += ps.byStrategy[t][n]
+		}
+	}
+	ps.mux.Unlock()
+
+	out := append([]string(nil), names...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return score[out[i]] > score[out[j]]
+	})
+	return out
+}
+
+func (ps *punchStats) snapshot() PunchStats {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	s := PunchStats{
+		ByNATType:    make(map[string]PunchOutcome, len(ps.byNAT)),
+		ByAddrFamily: make(map[string]PunchOutcome, len(ps.byFamily)),
+		ByStrategy:   make(map[string]map[string]int, len(ps.byStrategy)),
+	}
+	for k, v := range ps.byNAT {
+		s.ByNATType[k.String()] = v
+	}
+	for k, v := range ps.byFamily {
+		s.ByAddrFamily[k] = v
+	}
+	for k, v := range ps.byStrategy {
+		m := make(map[string]int, len(v))
+		for n, c := range v {
+			m[n] = c
+		}
+		s.ByStrategy[k.String()] = m
+	}
+	return s
+}
+
+// PunchStats returns the punch outcomes reported to this node while acting
+// as a service node.
+func (b *NatTraversal) PunchStats() PunchStats {
+	return b.stats.snapshot()
+}
+
+// addrFamily returns "ip4" or "ip6" for the address family of addr.
+func addrFamily(addr ma.Multiaddr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	if _, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		return "ip4"
+	}
+	if _, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+		return "ip6"
+	}
+	return "unknown"
+}
+
+func (b *NatTraversal) sendPunchResult(to peer.ID, res *protocol.Protocol_PunchResult) {
+	b.send(PacketWPeer{
+		peer: to,
+		packet: &protocol.Protocol{
+			Type:        protocol.Protocol_PUNCH_RESULT,
+			PunchResult: res,
+		},
+	})
+}
+
+func (b *NatTraversal) handlePunchResult(m PacketWPeer) {
+	res := m.packet.PunchResult
+
+	var addr ma.Multiaddr
+	if len(res.Addr) > 0 {
+		a, err := ma.NewMultiaddrBytes(res.Addr)
+		if err != nil {
+			log.Error("invalid address in punch result from ", m.peer, ": ", err)
+			return
+		}
+		addr = a
+	}
+	other, err := peer.IDHexDecode(string(res.PeerID))
+	if err != nil {
+		log.Error("invalid peer id in punch result from ", m.peer, ": ", err)
+		return
+	}
+
+	// The NAT type and the strategy are labels and keys, only known values
+	// are kept.
+	natType := parseNATType(res.NatType)
+	strategy := ""
+	if res.Success && b.inPipeline(res.Strategy) {
+		strategy = res.Strategy
+	}
+	family := addrFamily(addr)
+
+	ok := b.registry.addReport(PunchReport{
+		Time:      time.Now(),
+		From:      m.peer,
+		Peer:      other,
+		Success:   res.Success,
+		Addr:      addr,
+		Transport: transportOf(addr),
+		Strategy:  strategy,
+		Elapsed:   time.Duration(res.ElapsedMs) * time.Millisecond,
+		Attempts:  int(res.Attempts),
+		Error:     res.Error,
+		NATType:   natType.String(),
+	}, natType)
+	if !ok {
+		log.Info("Dropping punch result without coordination from ", m.peer, " about ", other)
+		return
+	}
+
+	log.Info("Punch result from ", m.peer, ": success=", res.Success, " addr=", addr, " elapsed=", res.ElapsedMs, "ms")
+
+	b.stats.record(natType, family, strategy, res.Success)
+
+	result := "failure"
+	if res.Success {
+		result = "success"
+	}
+	b.metrics.punchReports.WithLabelValues(result, natType.String(), family).Inc()
+}
+
+// inPipeline reports whether name is a strategy of the configured pipeline.
+func (b *NatTraversal) inPipeline(name string) bool {
+	for _, st := range b.cfg.pipeline {
+		if st.Strategy.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// strategyOrder returns the names of the configured strategies ranked by
+// the punches reported for peers behind the NAT types of p1 and p2.
+func (b *NatTraversal) strategyOrder(p1, p2 peer.ID) []string {
+	names := make([]string, 0, len(b.cfg.pipeline))
+	for _, st := range b.cfg.pipeline {
+		names = append(names, st.Strategy.Name())
+	}
+	return b.stats.rankStrategies(names, b.registry.natType(p1), b.registry.natType(p2))
+}
@@ -0,0 +1,198 @@
+package ntraversal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+func TestParseNATType(t *testing.T) {
+	cases := []struct {
+		in   string
+		want NATType
+	}{
+		{"Symmetric", NATSymmetric},
+		{"FullCone", NATFullCone},
+		{"None", NATNone},
+		{"", NATUnknown},
+		{"symmetric", NATUnknown},
+		{"<script>", NATUnknown},
+	}
+	for _, c := range cases {
+		if got := parseNATType(c.in); got != c.want {
+			t.Errorf("%q: got %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRankStrategies(t *testing.T) {
+	ps := newPunchStats()
+	for i := 0; i < 3; i++ {
+		ps.record(NATSymmetric, "ip4", "relay", true)
+	}
+	ps.record(NATFullCone, "ip4", "udp-punch", true)
+	ps.record(NATFullCone, "ip4", "", false)
+
+	names := []string{"direct", "udp-punch", "relay"}
+	cases := []struct {
+		name string
+		nats []NATType
+		want []string
+	}{
+		{"no reports", []NATType{NATNone, NATUnknown}, names},
+		{"symmetric", []NATType{NATSymmetric, NATSymmetric}, []string{"relay", "direct", "udp-punch"}},
+		{"full cone", []NATType{NATFullCone, NATUnknown}, []string{"udp-punch", "direct", "relay"}},
+		{"mixed", []NATType{NATFullCone, NATSymmetric}, []string{"relay", "udp-punch", "direct"}},
+	}
+	for _, c := range cases {
+		if got := ps.rankStrategies(names, c.nats...); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+type namedStrategy string
+
+func (s namedStrategy) Name() string { return string(s) }
+
+func (s namedStrategy) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	return ErrNotApplicable
+}
+
+func TestOrderStages(t *testing.T) {
+	stages := []Stage{
+		{Strategy: namedStrategy("a"), Timeout: time.Second},
+		{Strategy: namedStrategy("b"), Timeout: time.Second},
+		{Strategy: namedStrategy("c"), Timeout: time.Second},
+	}
+	cases := []struct {
+		order []string
+		want  string
+	}{
+		{nil, "abc"},
+		{[]string{"c", "a"}, "cab"},
+		{[]string{"x", "b", "b"}, "bac"},
+		{[]string{"c", "b", "a"}, "cba"},
+	}
+	for _, c := range cases {
+		var got string
+		for _, st := range orderStages(stages, c.order) {
+			got += st.Strategy.Name()
+		}
+		if got != c.want {
+			t.Errorf("%v: got %s, want %s", c.order, got, c.want)
+		}
+	}
+}
+
+func TestRegistryAddReport(t *testing.T) {
+	a, b, c := testPeer(t), testPeer(t), testPeer(t)
+
+	r := newRegistry()
+	r.startCoordination(a, b)
+	r.startCoordination(a, c)
+	r.coords[coordKey{a, c}].Started = time.Now().Add(-2 * coordinationTTL)
+
+	cases := []struct {
+		name string
+		from peer.ID
+		peer peer.ID
+		want bool
+	}{
+		{"initiator", a, b, true},
+		{"initiator again", a, b, false},
+		{"target", b, a, true},
+		{"coordination done", b, a, false},
+		{"never coordinated", b, c, false},
+		{"expired", a, c, false},
+	}
+	for _, tc := range cases {
+		if got := r.addReport(PunchReport{From: tc.from, Peer: tc.peer}, NATSymmetric); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if len(r.punches) != 2 {
+		t.Errorf("recorded %d reports, want 2", len(r.punches))
+	}
+}
+
+func TestRegistryPrune(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name      string
+		age       time.Duration
+		wantCoord bool
+		wantType  NATType
+	}{
+		{"fresh", time.Second, true, NATSymmetric},
+		{"coordination expired", 2 * coordinationTTL, false, NATSymmetric},
+		{"nat type expired", 2 * natTypeTTL, false, NATUnknown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := testPeer(t), testPeer(t)
+			r := newRegistry()
+			r.coords[coordKey{a, b}] = &Coordination{Initiator: a, Target: b, Started: now.Add(-c.age)}
+			r.natTypes[a] = natTypeReport{natType: NATSymmetric, reported: now.Add(-c.age)}
+
+			// Expired types are not handed out before they are pruned.
+			if got := r.natType(a); got != c.wantType {
+				t.Errorf("nat type %s, want %s", got, c.wantType)
+			}
+
+			r.prune(now)
+			if _, ok := r.coords[coordKey{a, b}]; ok != c.wantCoord {
+				t.Errorf("coordination kept: %v, want %v", ok, c.wantCoord)
+			}
+			if _, ok := r.natTypes[a]; ok != (c.wantType != NATUnknown) {
+				t.Errorf("nat type kept: %v, want %v", ok, c.wantType != NATUnknown)
+			}
+		})
+	}
+}
+
+func TestHandlePunchResult(t *testing.T) {
+	b := newTestTraversal(t, stubRouter{}, BootstrapServer)
+	from, to := testPeer(t), testPeer(t)
+	b.registry.startCoordination(from, to)
+
+	report := func(from, to peer.ID, natType, strategy string) {
+		b.handlePunchResult(PacketWPeer{
+			peer: from,
+			packet: &protocol.Protocol{
+				Type: protocol.Protocol_PUNCH_RESULT,
+				PunchResult: &protocol.Protocol_PunchResult{
+					Success:  true,
+					PeerID:   []byte(peer.IDHexEncode(to)),
+					NatType:  natType,
+					Strategy: strategy,
+				},
+			},
+		})
+	}
+	report(from, to, "garbage", "made-up")
+	report(to, from, "Symmetric", "relay")
+	report(testPeer(t), to, "FullCone", "relay")
+
+	got := b.PunchStats()
+	want := map[string]PunchOutcome{
+		"Unknown":   {Success: 1},
+		"Symmetric": {Success: 1},
+	}
+	if !reflect.DeepEqual(got.ByNATType, want) {
+		t.Errorf("ByNATType = %v, want %v", got.ByNATType, want)
+	}
+	wantStrategies := map[string]map[string]int{"Symmetric": {"relay": 1}}
+	if !reflect.DeepEqual(got.ByStrategy, wantStrategies) {
+		t.Errorf("ByStrategy = %v, want %v", got.ByStrategy, wantStrategies)
+	}
+	if order := b.strategyOrder(to, testPeer(t)); order[0] != "relay" {
+		t.Errorf("strategy order %v does not start with relay", order)
+	}
+}
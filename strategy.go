@@ -0,0 +1,344 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	host "github.com/libp2p/go-libp2p-host"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Strategy is one way of connecting to a peer we were asked to punch to.
+// Strategies run on both sides of a punch at about the same time.
+type Strategy interface {
+	// Name identifies the strategy in results, events and logs.
+	Name() string
+	// Connect tries to establish a connection to pi until ctx is done.
+	Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error
+}
+
+// Stage is a strategy in a pipeline together with its time budget.
+type Stage struct {
+	Strategy Strategy
+	Timeout  time.Duration
+}
+
+// ErrNotApplicable is returned by strategies which cannot be used for a
+// peer, e.g. because it has no address of the right transport. The
+// pipeline moves on to the next stage right away.
+var ErrNotApplicable = fmt.Errorf("strategy not applicable")
+
+// DefaultPipeline returns the stages used unless the Pipeline option is
+// given. PortPrediction is not part of it as it dials many addresses.
+func DefaultPipeline() []Stage {
+	return []Stage{
+		{Strategy: DirectDial{}, Timeout: 10 * time.Second},
+		{Strategy: PortMappingStrategy{}, Timeout: 5 * time.Second},
+		{Strategy: TCPSimultaneousOpen{}, Timeout: 30 * time.Second},
+		{Strategy: UDPPunch{}, Timeout: 15 * time.Second},
+		{Strategy: Relay{}, Timeout: 30 * time.Second},
+	}
+}
+
+// Host returns the host traversal runs on, for use by custom strategies.
+func (b *NatTraversal) Host() host.Host {
+	return b.host
+}
+
+type attemptsKey struct{}
+
+// withAttemptCounter returns a context counting the dials done with it.
+func withAttemptCounter(ctx context.Context) (context.Context, *int32) {
+	var n int32
+	return context.WithValue(ctx, attemptsKey{}, &n), &n
+}
+
+// Dial connects to pi once. Strategies should dial through it so the
+// attempt is counted and reported to subscribers and metrics. A backoff
+// of the peer does not refuse the dial and a failure does not back off
+// the dials of the application: on hosts with the PunchTransport, TCP
+// candidates are dialed past the swarm, other dials clear the backoff of
+// the peer while they run.
+func (b *NatTraversal) Dial(ctx context.Context, pi pstore.PeerInfo) error {
+	attempt := 1
+	if n, ok := ctx.Value(attemptsKey{}).(*int32); ok {
+		attempt = int(atomic.AddInt32(n, 1))
+	}
+
+	b.events.emit(Event{Type: EvtDialAttemptStarted, Peer: pi.ID, Attempt: attempt, Addrs: pi.Addrs})
+	b.metrics.punchAttempts.Inc()
+
+	err := b.raceDial(ctx, pi, attempt)
+	if err != nil {
+		var addr ma.Multiaddr
+		if len(pi.Addrs) == 1 {
+			addr = pi.Addrs[0]
+		}
+		err = newDialError(pi.ID, addr, err)
+		b.events.emit(Event{Type: EvtDialAttemptFailed, Peer: pi.ID, Attempt: attempt, Err: err})
+	}
+	return err
+}
+
+// runPipeline runs the configured stages until one connects to pi, first
+// those the service node ranked in order. It returns the name of the
+// strategy which succeeded and the number of dials done.
+func (b *NatTraversal) runPipeline(ctx context.Context, pi pstore.PeerInfo, order []string) (strategy string, n int, err error) {
+	ctx, attempts := withAttemptCounter(ctx)
+
+	err = ErrNotApplicable
+	for _, st := range orderStages(b.cfg.pipeline, order) {
+		name := st.Strategy.Name()
+
+		start := time.Now()
+		sctx, cancel := context.WithTimeout(ctx, st.Timeout)
+		serr := st.Strategy.Connect(sctx, b, pi)
+		cancel()
+
+		if serr != ErrNotApplicable {
+			traceFrom(ctx).add(TraceStep{Name: StepStrategy, Time: start, Duration: time.Since(start), Strategy: name, Err: serr})
+		}
+
+		if serr == nil {
+			log.Info("Strategy ", name, " connected to: ", pi.ID)
+			return name, int(atomic.LoadInt32(attempts)), nil
+		}
+		if serr == ErrNotApplicable {
+			log.Debug("Strategy ", name, " not applicable to: ", pi.ID)
+			continue
+		}
+
+		log.Info("Strategy ", name, " failed: ", serr)
+		err = fmt.Errorf("%s: %w", name, serr)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err == ErrNotApplicable {
+		// No stage had an address it could dial.
+		err = newDialError(pi.ID, nil, ErrAllAddrsFiltered)
+	}
+	return "", int(atomic.LoadInt32(attempts)), err
+}
+
+// orderStages returns the stages of the strategies named in order first, in
+// that order, followed by the others in their configured order.
+func orderStages(stages []Stage, order []string) []Stage {
+	out := make([]Stage, 0, len(stages))
+	used := make([]bool, len(stages))
+	for _, name := range order {
+		for i, st := range stages {
+			if !used[i] && st.Strategy.Name() == name {
+				out = append(out, st)
+				used[i] = true
+				break
+			}
+		}
+	}
+	for i, st := range stages {
+		if !used[i] {
+			out = append(out, st)
+		}
+	}
+	return out
+}
+
+func filterAddrs(addrs []ma.Multiaddr, keep func(ma.Multiaddr) bool) []ma.Multiaddr {
+	var out []ma.Multiaddr
+	for _, a := range addrs {
+		if keep(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func hasProtocol(addr ma.Multiaddr, code int) bool {
+	_, err := addr.ValueForProtocol(code)
+	return err == nil
+}
+
+func isTCPAddr(addr ma.Multiaddr) bool {
+	return hasProtocol(addr, ma.P_TCP) && !isRelayAddr(addr)
+}
+
+func isUDPAddr(addr ma.Multiaddr) bool {
+	return hasProtocol(addr, ma.P_UDP) && !isRelayAddr(addr)
+}
+
+func isDirectAddr(addr ma.Multiaddr) bool {
+	return !isRelayAddr(addr)
+}
+
+// DirectDial dials all addresses of the peer once, which is enough when
+// the peer is reachable or behind a full cone NAT. Relay addresses are
+// left to the Relay strategy.
+type DirectDial struct{}
+
+// Name implements Strategy.
+func (DirectDial) Name() string { return "direct" }
+
+// Connect implements Strategy.
+func (DirectDial) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	addrs := filterAddrs(pi.Addrs, isDirectAddr)
+	if len(addrs) == 0 {
+		return ErrNotApplicable
+	}
+	return directly(nt, pi.ID, nt.Dial(ctx, pstore.PeerInfo{ID: pi.ID, Addrs: addrs}))
+}
+
+// directly returns the error of a dial to p, or errNoDirectConn if the dial
+// succeeded without a direct connection: dials through the host return any
+// connection, relayed ones too.
+func directly(nt *NatTraversal, p peer.ID, err error) error {
+	if err == nil && nt.directConn(p) == nil {
+		return errNoDirectConn
+	}
+	return err
+}
+
+// PortMappingStrategy waits for the peer to dial us on a port mapped with
+// the PortMapping option, until a connection which is not relayed exists.
+// It is skipped when no port is mapped.
+type PortMappingStrategy struct{}
+
+// Name implements Strategy.
+func (PortMappingStrategy) Name() string { return "portmap" }
+
+// Connect implements Strategy.
+func (PortMappingStrategy) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	if len(nt.MappedAddrs()) == 0 {
+		return ErrNotApplicable
+	}
+
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if nt.directConn(pi.ID) != nil {
+			return nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TCPSimultaneousOpen dials the TCP addresses of the peer repeatedly while
+// the peer does the same, so both NATs see outgoing SYNs and let the other
+// side in. Dials are repeated following the retry policy; Attempts, if
+// set, overrides its number of dials.
+type TCPSimultaneousOpen struct {
+	Attempts int
+}
+
+// Name implements Strategy.
+func (TCPSimultaneousOpen) Name() string { return "tcp-simultaneous-open" }
+
+// Connect implements Strategy.
+func (s TCPSimultaneousOpen) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	addrs := filterAddrs(pi.Addrs, isTCPAddr)
+	if len(addrs) == 0 {
+		return ErrNotApplicable
+	}
+	return directly(nt, pi.ID, dialRepeatedly(ctx, nt, pstore.PeerInfo{ID: pi.ID, Addrs: addrs}, s.Attempts))
+}
+
+// UDPPunch dials the UDP based (e.g. QUIC) addresses of the peer
+// repeatedly while the peer does the same. Attempts, if set, overrides the
+// number of dials of the retry policy.
+type UDPPunch struct {
+	Attempts int
+}
+
+// Name implements Strategy.
+func (UDPPunch) Name() string { return "udp-punch" }
+
+// Connect implements Strategy.
+func (s UDPPunch) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	addrs := filterAddrs(pi.Addrs, isUDPAddr)
+	if len(addrs) == 0 {
+		return ErrNotApplicable
+	}
+	return directly(nt, pi.ID, dialRepeatedly(ctx, nt, pstore.PeerInfo{ID: pi.ID, Addrs: addrs}, s.Attempts))
+}
+
+// PortPrediction targets symmetric NATs, which allocate a new port for
+// every destination. Besides the observed TCP ports it dials the next
+// Range ports, guessing the port the NAT of the peer allocates for us.
+type PortPrediction struct {
+	Range int
+}
+
+// Name implements Strategy.
+func (PortPrediction) Name() string { return "port-prediction" }
+
+// Connect implements Strategy.
+func (s PortPrediction) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	var predicted []ma.Multiaddr
+	for _, addr := range filterAddrs(pi.Addrs, isTCPAddr) {
+		predicted = append(predicted, predictAddrs(addr, s.Range)...)
+	}
+	if len(predicted) == 0 {
+		return ErrNotApplicable
+	}
+	return directly(nt, pi.ID, nt.Dial(ctx, pstore.PeerInfo{ID: pi.ID, Addrs: predicted}))
+}
+
+// predictAddrs returns addr with its TCP port incremented 1 to n times.
+func predictAddrs(addr ma.Multiaddr, n int) []ma.Multiaddr {
+	var ipProto string
+	ip, err := addr.ValueForProtocol(ma.P_IP4)
+	if err == nil {
+		ipProto = "ip4"
+	} else if ip, err = addr.ValueForProtocol(ma.P_IP6); err == nil {
+		ipProto = "ip6"
+	} else {
+		return nil
+	}
+
+	sport, err := addr.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return nil
+	}
+	var port int
+	if _, err := fmt.Sscan(sport, &port); err != nil {
+		return nil
+	}
+
+	var out []ma.Multiaddr
+	for i := 1; i <= n && port+i <= 65535; i++ {
+		a, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s/tcp/%d", ipProto, ip, port+i))
+		if err != nil {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// Relay connects through a circuit relay when no direct connection could
+// be established.
+type Relay struct{}
+
+// Name implements Strategy.
+func (Relay) Name() string { return "relay" }
+
+// Connect implements Strategy.
+func (Relay) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	addr, err := ma.NewMultiaddr("/p2p-circuit/ipfs/" + pi.ID.Pretty())
+	if err != nil {
+		return err
+	}
+	if err := nt.Dial(ctx, pstore.PeerInfo{ID: pi.ID, Addrs: []ma.Multiaddr{addr}}); err != nil {
+		return err
+	}
+
+	nt.events.emit(Event{Type: EvtRelayFallback, Peer: pi.ID, Addrs: []ma.Multiaddr{addr}})
+	return nil
+}
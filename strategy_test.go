@@ -0,0 +1,91 @@
+package ntraversal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// noopDialer reports every dial as connected without connecting, like the
+// host does when it already has a relayed connection.
+type noopDialer struct{}
+
+func (noopDialer) DialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) error {
+	return nil
+}
+
+const testRelayAddr = "/ip4/1.2.3.4/tcp/4001/ipfs/QmQnAZsyiJSovuqg8zjP3nKdm6Pwb75Mpn8HnGyD5WYZ15/p2p-circuit"
+
+func TestDirectStrategiesNeedDirectConn(t *testing.T) {
+	const (
+		tcpAddr = "/ip4/1.2.3.4/tcp/4001"
+		udpAddr = "/ip4/1.2.3.4/udp/4001/quic"
+	)
+
+	cases := []struct {
+		name     string
+		strategy Strategy
+		// mapped announces a mapped port for PortMappingStrategy.
+		mapped bool
+		// addrs replaces the addresses of the peer.
+		addrs []string
+		// connect connects the peers directly.
+		connect bool
+		// noopDialer stands in for a relayed connection to the peer.
+		dialer AddrDialer
+		want   error
+	}{
+		{"direct relay address", DirectDial{}, false, []string{testRelayAddr}, false, nil, ErrNotApplicable},
+		{"direct relayed", DirectDial{}, false, nil, false, noopDialer{}, errNoDirectConn},
+		{"direct connected", DirectDial{}, false, nil, true, nil, nil},
+		{"portmap not mapped", PortMappingStrategy{}, false, nil, true, nil, ErrNotApplicable},
+		{"portmap no conn", PortMappingStrategy{}, true, nil, false, nil, context.DeadlineExceeded},
+		{"portmap connected", PortMappingStrategy{}, true, nil, true, nil, nil},
+		{"tcp relayed", TCPSimultaneousOpen{}, false, []string{tcpAddr}, false, noopDialer{}, errNoDirectConn},
+		{"tcp connected", TCPSimultaneousOpen{}, false, []string{tcpAddr}, true, nil, nil},
+		{"udp relayed", UDPPunch{}, false, []string{udpAddr}, false, noopDialer{}, errNoDirectConn},
+		{"udp connected", UDPPunch{}, false, []string{udpAddr}, true, nil, nil},
+		{"prediction relayed", PortPrediction{Range: 2}, false, []string{tcpAddr}, false, noopDialer{}, errNoDirectConn},
+		{"prediction connected", PortPrediction{Range: 2}, false, []string{tcpAddr}, true, nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mn := mocknet.New(context.Background())
+			var opts []Option
+			if c.dialer != nil {
+				opts = append(opts, WithAddrDialer(c.dialer))
+			}
+			a := newTestTraversalOn(t, mn, nil, opts...)
+			b := newTestTraversalOn(t, mn, nil)
+			if c.connect {
+				if _, err := mn.LinkPeers(a.host.ID(), b.host.ID()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.mapped {
+				a.mappedAddrs = []ma.Multiaddr{mustAddr(t, "/ip4/203.0.113.7/tcp/4001")}
+			}
+			pi := pstore.PeerInfo{ID: b.host.ID(), Addrs: b.host.Addrs()}
+			if c.addrs != nil {
+				pi.Addrs = mustAddrs(t, c.addrs)
+			}
+			if c.connect && c.mapped {
+				// The peer dials the mapped port.
+				if _, err := mn.ConnectPeers(b.host.ID(), a.host.ID()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			if err := c.strategy.Connect(ctx, a, pi); err != c.want {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
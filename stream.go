@@ -2,6 +2,7 @@ package ntraversal
 
 import (
 	"bufio"
+	"sync"
 
 	ggio "github.com/gogo/protobuf/io"
 	proto "github.com/golang/protobuf/proto"
@@ -14,9 +15,16 @@ type streamWrapper struct {
 	bw *bufio.Writer
 	r  *ggio.ReadCloser
 	w  *ggio.WriteCloser
+
+	// wmux serialises writes as handlers reply concurrently and a message
+	// must be written and flushed as a whole.
+	wmux sync.Mutex
 }
 
-func (sw streamWrapper) writeMsg(msg proto.Message) error {
+func (sw *streamWrapper) writeMsg(msg proto.Message) error {
+	sw.wmux.Lock()
+	defer sw.wmux.Unlock()
+
 	w := *sw.w
 	bw := sw.bw
 
@@ -28,21 +36,31 @@ func (sw streamWrapper) writeMsg(msg proto.Message) error {
 	return bw.Flush()
 }
 
-func (sw streamWrapper) readMsg(incoming chan PacketWPeer) error {
+// readMsg reads messages from the stream until it fails and returns the
+// error (io.EOF when the remote closed the stream), or ErrClosed once
+// closed is closed. Every message is decoded into a freshly allocated
+// packet as handlers run concurrently.
+func (sw *streamWrapper) readMsg(incoming chan PacketWPeer, closed <-chan struct{}) error {
 	r := *sw.r
 	s := *sw.s
 
-	protocolPacket := &protocol.Protocol{}
+	remote := s.Conn().RemotePeer()
 
 	for {
+		protocolPacket := &protocol.Protocol{}
+
 		err := r.ReadMsg(protocolPacket)
 		if err != nil {
 			return err
 		}
 
-		incoming <- PacketWPeer{
-			peer:   s.Conn().RemotePeer(),
+		select {
+		case incoming <- PacketWPeer{
+			peer:   remote,
 			packet: protocolPacket,
+		}:
+		case <-closed:
+			return ErrClosed
 		}
 	}
 }
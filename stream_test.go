@@ -0,0 +1,55 @@
+package ntraversal
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+	"testing"
+
+	ggio "github.com/gogo/protobuf/io"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+func TestWriteMsgConcurrent(t *testing.T) {
+	const writers, perWriter = 8, 50
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriterSize(&buf, 16)
+	w := ggio.NewDelimitedWriter(bw)
+	sw := &streamWrapper{bw: bw, w: &w}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				err := sw.writeMsg(&protocol.Protocol{
+					Type:   protocol.Protocol_ERROR,
+					PeerID: &protocol.Protocol_PeerID{Id: bytes.Repeat([]byte{byte(i)}, 40)},
+					Error:  &protocol.Protocol_Error{Message: "interleaving check"},
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r := ggio.NewDelimitedReader(&buf, 1<<20)
+	for n := 0; n < writers*perWriter; n++ {
+		m := &protocol.Protocol{}
+		if err := r.ReadMsg(m); err != nil {
+			t.Fatalf("message %d: %s", n, err)
+		}
+		id := m.GetPeerID().GetId()
+		if len(id) != 40 || !bytes.Equal(id, bytes.Repeat(id[:1], 40)) {
+			t.Fatalf("message %d is corrupted: %x", n, id)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d trailing bytes", buf.Len())
+	}
+}
@@ -0,0 +1,221 @@
+//go:build integration
+// +build integration
+
+// Package test holds integration tests which need more than the Go
+// toolchain to run.
+package test
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// TestNetnsTCPSimultaneousOpen punches through real NATs emulated with
+// Linux network namespaces:
+//
+//	nt-a (10.0.1.2) -- nt-nata (MASQUERADE) --+
+//	                                          +-- nt-wan bridge -- nt-srv (bootstrapd)
+//	nt-b (10.0.2.2) -- nt-natb (MASQUERADE) --+
+//
+// Client b registers with bootstrapd, client a asks for a coordinated
+// punch to b. The punch must connect a straight to b's NAT.
+//
+// Run as root with: go test -tags integration ./test
+func TestNetnsTCPSimultaneousOpen(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("netns integration test must run as root")
+	}
+	for _, bin := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	work := t.TempDir()
+	build(t, work, "bootstrapd", "../cmd")
+	build(t, work, "client", "../example")
+	build(t, work, "ntctl", "../cmd/ntctl")
+
+	setupNetns(t)
+
+	const natB = "198.51.100.3"
+	srvID := writeKey(t, filepath.Join(work, "srv.key"))
+	srv := fmt.Sprintf("/ip4/198.51.100.1/tcp/3001/p2p/%s", srvID.Pretty())
+
+	start(ctx, t, "nt-srv", filepath.Join(work, "bootstrapd"), "-p", "3001", "-key", filepath.Join(work, "srv.key"))
+	time.Sleep(time.Second)
+
+	bID := nodeID(t, start(ctx, t, "nt-b", filepath.Join(work, "client"), "-b", srv))
+	time.Sleep(2 * time.Second)
+
+	out, err := exec.CommandContext(ctx, "ip", "netns", "exec", "nt-a",
+		filepath.Join(work, "ntctl"), "-b", srv, "-json", "-timeout", "90s", "punch", bID.Pretty()).Output()
+	if err != nil && len(out) == 0 {
+		t.Fatalf("ntctl: %s", err)
+	}
+
+	var res struct {
+		Success  bool   `json:"success"`
+		Addr     string `json:"addr"`
+		Strategy string `json:"strategy"`
+		Error    string `json:"error"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("invalid ntctl output %q: %s", out, err)
+	}
+	if !res.Success {
+		t.Fatalf("punch failed: %s", res.Error)
+	}
+	if res.Strategy == "relay" {
+		t.Fatalf("punch fell back to the relay")
+	}
+	if !strings.Contains(res.Addr, "/ip4/"+natB+"/") {
+		t.Fatalf("connected to %s, not to b's NAT at %s", res.Addr, natB)
+	}
+}
+
+func build(t *testing.T, dir, name, pkg string) {
+	t.Helper()
+
+	cmd := exec.Command("go", "build", "-o", filepath.Join(dir, name), pkg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %s\n%s", pkg, err, out)
+	}
+}
+
+// writeKey writes a new bootstrapd identity to path and returns its peer
+// ID.
+func writeKey(t *testing.T, path string) peer.ID {
+	t.Helper()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// start runs name in the network namespace ns until the test ends and
+// returns its output.
+func start(ctx context.Context, t *testing.T, ns, name string, args ...string) io.Reader {
+	t.Helper()
+
+	cmd := exec.CommandContext(ctx, "ip", append([]string{"netns", "exec", ns, name}, args...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return out
+}
+
+// nodeID returns the peer ID the example client prints on start and
+// discards the rest of its output.
+func nodeID(t *testing.T, out io.Reader) peer.ID {
+	t.Helper()
+
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 3 || f[0] != "This" || f[1] != "node:" {
+			continue
+		}
+		id, err := peer.IDB58Decode(f[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(ioutil.Discard, out)
+		return id
+	}
+	t.Fatal("client exited without printing its peer ID")
+	return ""
+}
+
+func setupNetns(t *testing.T) {
+	t.Helper()
+
+	namespaces := []string{"nt-wan", "nt-srv", "nt-nata", "nt-natb", "nt-a", "nt-b"}
+	t.Cleanup(func() {
+		for _, ns := range namespaces {
+			exec.Command("ip", "netns", "del", ns).Run()
+		}
+	})
+
+	run := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	for _, ns := range namespaces {
+		run("ip", "netns", "add", ns)
+		run("ip", "-n", ns, "link", "set", "lo", "up")
+	}
+
+	// wan: a bridge connecting the service node and both NATs
+	run("ip", "-n", "nt-wan", "link", "add", "br0", "type", "bridge")
+	run("ip", "-n", "nt-wan", "link", "set", "br0", "up")
+	for ns, addr := range map[string]string{
+		"nt-srv":  "198.51.100.1",
+		"nt-nata": "198.51.100.2",
+		"nt-natb": "198.51.100.3",
+	} {
+		run("ip", "link", "add", "wan-"+ns, "type", "veth", "peer", "name", "wan0")
+		run("ip", "link", "set", "wan0", "netns", ns)
+		run("ip", "link", "set", "wan-"+ns, "netns", "nt-wan")
+		run("ip", "-n", "nt-wan", "link", "set", "wan-"+ns, "master", "br0", "up")
+		run("ip", "-n", ns, "addr", "add", addr+"/24", "dev", "wan0")
+		run("ip", "-n", ns, "link", "set", "wan0", "up")
+	}
+
+	for _, l := range []struct{ nat, ns, net string }{
+		{"nt-nata", "nt-a", "10.0.1"},
+		{"nt-natb", "nt-b", "10.0.2"},
+	} {
+		run("ip", "link", "add", "lan0", "netns", l.nat, "type", "veth", "peer", "name", "eth0", "netns", l.ns)
+		run("ip", "-n", l.nat, "addr", "add", l.net+".1/24", "dev", "lan0")
+		run("ip", "-n", l.nat, "link", "set", "lan0", "up")
+		run("ip", "-n", l.ns, "addr", "add", l.net+".2/24", "dev", "eth0")
+		run("ip", "-n", l.ns, "link", "set", "eth0", "up")
+		run("ip", "-n", l.ns, "route", "add", "default", "via", l.net+".1")
+
+		run("ip", "netns", "exec", l.nat, "sysctl", "-qw", "net.ipv4.ip_forward=1")
+		run("ip", "netns", "exec", l.nat, "iptables", "-t", "nat", "-A", "POSTROUTING", "-o", "wan0", "-j", "MASQUERADE")
+	}
+}
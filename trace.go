@@ -0,0 +1,205 @@
+package ntraversal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of the steps in a punch trace.
+const (
+	// StepRequestSent is the connection request sent to a service node.
+	StepRequestSent = "request-sent"
+	// StepInstructionReceived is the punch instruction from the service
+	// node. Its duration is the time since the request was sent, which
+	// includes the peer lookups of the service node.
+	StepInstructionReceived = "instruction-received"
+	// StepPeerUnknown is the service node failing to find the peer.
+	StepPeerUnknown = "peer-unknown"
+	// StepServiceNodeError is the service node refusing to coordinate.
+	StepServiceNodeError = "service-node-error"
+	// StepStrategy is a strategy of the pipeline being run.
+	StepStrategy = "strategy"
+	// StepDial is a dial to one or more addresses of the peer.
+	StepDial = "dial"
+	// StepOutcome is the end of the punch.
+	StepOutcome = "outcome"
+)
+
+// TraceStep is one step of a punch.
+type TraceStep struct {
+	Name string
+	// Time is when the step started.
+	Time     time.Time
+	Duration time.Duration
+	Strategy string
+	// Attempt is the 1-based dial attempt for dial steps.
+	Attempt   int
+	Addrs     []ma.Multiaddr
+	Transport string
+	Err       error
+}
+
+// PunchResult describes a finished punch with a timeline of its steps.
+type PunchResult struct {
+	Peer peer.ID
+	// Conn is the connection established to Peer, preferring a direct
+	// one. It is nil for failed punches.
+	Conn inet.Conn
+	// Addr is the remote address of Conn.
+	Addr      ma.Multiaddr
+	Transport string
+	Start     time.Time
+	Elapsed   time.Duration
+	// Strategy is the name of the strategy which connected.
+	Strategy string
+	// Attempts is the number of dials done.
+	Attempts int
+	Trace    []TraceStep
+}
+
+// PunchError is the error of a failed punch. Its result holds the trace
+// of what was tried.
+type PunchError struct {
+	Result *PunchResult
+	Err    error
+}
+
+func (e *PunchError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PunchError) Unwrap() error {
+	return e.Err
+}
+
+// punchTrace collects the steps of one punch. A nil *punchTrace records
+// nothing.
+type punchTrace struct {
+	mux      sync.Mutex
+	peer     peer.ID
+	start    time.Time
+	steps    []TraceStep
+	strategy string
+	attempts int
+	finished bool
+}
+
+func newPunchTrace(p peer.ID) *punchTrace {
+	return &punchTrace{peer: p, start: time.Now()}
+}
+
+func (t *punchTrace) add(s TraceStep) {
+	if t == nil {
+		return
+	}
+	if s.Time.IsZero() {
+		s.Time = time.Now()
+	}
+
+	t.mux.Lock()
+	t.steps = append(t.steps, s)
+	t.mux.Unlock()
+}
+
+// finish records the outcome of the punch. Only the first outcome is
+// recorded.
+func (t *punchTrace) finish(strategy string, attempts int, err error) {
+	if t == nil {
+		return
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.finished {
+		return
+	}
+	t.finished = true
+	t.steps = append(t.steps, TraceStep{Name: StepOutcome, Time: time.Now(), Strategy: strategy, Attempt: attempts, Err: err})
+	t.strategy = strategy
+	t.attempts = attempts
+}
+
+func (t *punchTrace) result() *PunchResult {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return &PunchResult{
+		Peer:     t.peer,
+		Start:    t.start,
+		Elapsed:  time.Since(t.start),
+		Strategy: t.strategy,
+		Attempts: t.attempts,
+		Trace:    append([]TraceStep(nil), t.steps...),
+	}
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, t *punchTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *punchTrace {
+	t, _ := ctx.Value(traceKey{}).(*punchTrace)
+	return t
+}
+
+// exportTrace turns a punch trace into a span with a child span per step
+// when a tracer is configured.
+func (b *NatTraversal) exportTrace(res *PunchResult, err error) {
+	tracer := b.cfg.tracer
+	if tracer == nil {
+		return
+	}
+
+	ctx, span := tracer.Start(context.Background(), "punch",
+		trace.WithTimestamp(res.Start),
+		trace.WithAttributes(
+			attribute.String("peer", res.Peer.Pretty()),
+			attribute.String("strategy", res.Strategy),
+			attribute.Int("attempts", res.Attempts),
+		))
+
+	for _, s := range res.Trace {
+		attrs := []attribute.KeyValue{attribute.String("step", s.Name)}
+		if s.Strategy != "" {
+			attrs = append(attrs, attribute.String("strategy", s.Strategy))
+		}
+		if s.Attempt > 0 {
+			attrs = append(attrs, attribute.Int("attempt", s.Attempt))
+		}
+		if s.Transport != "" {
+			attrs = append(attrs, attribute.String("transport", s.Transport))
+		}
+		if len(s.Addrs) > 0 {
+			addrs := make([]string, 0, len(s.Addrs))
+			for _, a := range s.Addrs {
+				addrs = append(addrs, a.String())
+			}
+			attrs = append(attrs, attribute.StringSlice("addrs", addrs))
+		}
+
+		_, child := tracer.Start(ctx, s.Name, trace.WithTimestamp(s.Time), trace.WithAttributes(attrs...))
+		if s.Err != nil {
+			child.RecordError(s.Err)
+			child.SetStatus(codes.Error, s.Err.Error())
+		}
+		child.End(trace.WithTimestamp(s.Time.Add(s.Duration)))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(res.Start.Add(res.Elapsed)))
+}
@@ -0,0 +1,195 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newRecordingTracer returns a Tracer option recording the spans ended.
+func newRecordingTracer() (Option, *tracetest.SpanRecorder) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	return Tracer(tp.Tracer("test")), sr
+}
+
+// spanAttrs returns the attributes of a span by key.
+func spanAttrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestExportTrace(t *testing.T) {
+	opt, sr := newRecordingTracer()
+	b := newTestTraversal(t, nil, opt)
+
+	start := time.Now()
+	addr := mustAddr(t, "/ip4/1.2.3.4/tcp/4001")
+	dialErr := fmt.Errorf("connection refused")
+	res := &PunchResult{
+		Peer:     testPeer(t),
+		Start:    start,
+		Elapsed:  time.Second,
+		Strategy: "direct",
+		Attempts: 2,
+		Trace: []TraceStep{
+			{Name: StepRequestSent, Time: start},
+			{Name: StepDial, Time: start, Duration: time.Millisecond, Attempt: 1, Addrs: []ma.Multiaddr{addr}, Transport: "tcp", Err: dialErr},
+			{Name: StepStrategy, Time: start, Strategy: "direct"},
+		},
+	}
+	b.exportTrace(res, dialErr)
+
+	spans := sr.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("%d spans, want a punch span and 3 step spans", len(spans))
+	}
+	punch := spans[len(spans)-1]
+	if punch.Name() != "punch" {
+		t.Fatalf("last span %q, want the punch span", punch.Name())
+	}
+	attrs := spanAttrs(punch)
+	if attrs["peer"].AsString() != res.Peer.Pretty() || attrs["strategy"].AsString() != "direct" || attrs["attempts"].AsInt64() != 2 {
+		t.Fatalf("punch attributes %v", punch.Attributes())
+	}
+	if punch.Status().Code != codes.Error || punch.Status().Description != dialErr.Error() {
+		t.Fatalf("punch status %+v, want the error", punch.Status())
+	}
+	if !punch.EndTime().Equal(start.Add(time.Second)) {
+		t.Fatalf("punch ended at %s, want %s", punch.EndTime(), start.Add(time.Second))
+	}
+
+	cases := []struct {
+		name   string
+		attrs  map[attribute.Key]string
+		failed bool
+	}{
+		{StepRequestSent, nil, false},
+		{StepDial, map[attribute.Key]string{"transport": "tcp", "addrs": `["` + addr.String() + `"]`}, true},
+		{StepStrategy, map[attribute.Key]string{"strategy": "direct"}, false},
+	}
+	for i, c := range cases {
+		s := spans[i]
+		if s.Name() != c.name {
+			t.Fatalf("span %d %q, want %q", i, s.Name(), c.name)
+		}
+		if s.Parent().SpanID() != punch.SpanContext().SpanID() {
+			t.Errorf("span %q is not a child of the punch span", c.name)
+		}
+		attrs := spanAttrs(s)
+		if attrs["step"].AsString() != c.name {
+			t.Errorf("span %q of step %q", c.name, attrs["step"].AsString())
+		}
+		for k, want := range c.attrs {
+			if got := attrs[k].Emit(); got != want {
+				t.Errorf("span %q attribute %s %q, want %q", c.name, k, got, want)
+			}
+		}
+		if failed := s.Status().Code == codes.Error; failed != c.failed {
+			t.Errorf("span %q failed %v, want %v", c.name, failed, c.failed)
+		}
+	}
+}
+
+func TestTraceExportedOnEveryOutcome(t *testing.T) {
+	sn := testPeer(t)
+
+	cases := []struct {
+		name string
+		// finish ends the punch pp to target requested by b.
+		finish func(b *NatTraversal, target peer.ID, pp *pendingPunch)
+		step   string
+		failed bool
+	}{
+		{"peer unknown", func(b *NatTraversal, target peer.ID, pp *pendingPunch) {
+			b.handlePeerUnknown(PacketWPeer{
+				peer:   sn,
+				packet: &protocol.Protocol{Type: protocol.Protocol_PEER_UNKNOWN, PeerID: hexID(target)},
+			})
+		}, StepPeerUnknown, true},
+		{"service node error", func(b *NatTraversal, target peer.ID, pp *pendingPunch) {
+			b.handleError(PacketWPeer{
+				peer: sn,
+				packet: &protocol.Protocol{
+					Type:   protocol.Protocol_ERROR,
+					Error:  &protocol.Protocol_Error{Message: "rate limited"},
+					PeerID: hexID(target),
+				},
+			})
+		}, StepServiceNodeError, true},
+		{"timeout", func(b *NatTraversal, target peer.ID, pp *pendingPunch) {
+			// The only caller of Punch timed out.
+			b.leavePunch(target, pp, context.DeadlineExceeded)
+		}, StepRequestSent, true},
+		{"punched", func(b *NatTraversal, target peer.ID, pp *pendingPunch) {
+			info, err := pstore.PeerInfo{ID: target}.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.handleHolePunchRequest(PacketWPeer{
+				peer: sn,
+				packet: &protocol.Protocol{
+					Type:     protocol.Protocol_HOLE_PUNCH_REQUEST,
+					PeerInfo: &protocol.Protocol_PeerInfo{Info: info},
+				},
+			})
+		}, StepStrategy, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opt, sr := newRecordingTracer()
+			connected := connectedStrategy("connected")
+			b := newTestTraversal(t, nil, opt, Pipeline(Stage{Strategy: connected, Timeout: time.Second}))
+			b.serviceNodes = []peer.ID{sn}
+			target := testPeer(t)
+
+			pp, err := b.requestPunch(context.Background(), target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.finish(b, target, pp)
+			<-pp.done
+
+			var punches int
+			names := make(map[string]bool)
+			for _, s := range sr.Ended() {
+				names[s.Name()] = true
+				if s.Name() != "punch" {
+					continue
+				}
+				punches++
+				if failed := s.Status().Code == codes.Error; failed != c.failed {
+					t.Errorf("punch failed %v, want %v", failed, c.failed)
+				}
+			}
+			if punches != 1 {
+				t.Fatalf("%d punch spans, want 1", punches)
+			}
+			if !names[c.step] || !names[StepOutcome] {
+				t.Fatalf("spans %v without %q and the outcome", names, c.step)
+			}
+		})
+	}
+}
+
+// connectedStrategy reports every punch as connected.
+type connectedStrategy string
+
+func (s connectedStrategy) Name() string { return string(s) }
+
+func (s connectedStrategy) Connect(ctx context.Context, nt *NatTraversal, pi pstore.PeerInfo) error {
+	return nil
+}
@@ -0,0 +1,241 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	transport "github.com/libp2p/go-libp2p-transport"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	tcp "github.com/libp2p/go-tcp-transport"
+	ws "github.com/libp2p/go-ws-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrNotListening is returned by punch dials on hosts whose punch transport
+// does not listen on any address, as punched connections are handed to the
+// swarm through its listeners.
+var ErrNotListening = fmt.Errorf("punch transport not listening")
+
+var errListenerClosed = fmt.Errorf("listener closed")
+
+// PunchTransport is a libp2p option installing the TCP transport punches
+// dial through, together with the websocket transport libp2p has by
+// default. Like any transport option it replaces the default transports
+// and listen addresses of libp2p, so ListenAddrs must be given.
+var PunchTransport = libp2p.ChainOptions(
+	libp2p.Transport(newTCPPunchTransport),
+	libp2p.Transport(ws.New),
+)
+
+func newTCPPunchTransport(u *tptu.Upgrader) transport.Transport {
+	return newPunchTransport(tcp.NewTCPTransport(u))
+}
+
+// punchTransport wraps the TCP transport of a host so punches can dial a
+// single address. The swarm dials peers, not addresses: it returns any
+// connection it has to the peer, relayed ones included, merges concurrent
+// dials and refuses to dial peers it backs off after failed dials. Punches
+// dial the wrapped transport instead and hand the connection to the
+// listeners of the transport, from which the swarm takes it like an
+// accepted one.
+type punchTransport struct {
+	transport.Transport
+
+	punched chan transport.Conn
+
+	mux       sync.Mutex
+	listeners int
+}
+
+func newPunchTransport(t transport.Transport) *punchTransport {
+	return &punchTransport{
+		Transport: t,
+		punched:   make(chan transport.Conn),
+	}
+}
+
+func (t *punchTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	l, err := t.Transport.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mux.Lock()
+	t.listeners++
+	t.mux.Unlock()
+
+	pl := &punchListener{
+		Listener: l,
+		t:        t,
+		accepted: make(chan acceptResult),
+		closed:   make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+// hand passes a punched connection to one of the listeners.
+func (t *punchTransport) hand(ctx context.Context, c transport.Conn) error {
+	t.mux.Lock()
+	listening := t.listeners > 0
+	t.mux.Unlock()
+	if !listening {
+		c.Close()
+		return ErrNotListening
+	}
+
+	select {
+	case t.punched <- c:
+		return nil
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+type acceptResult struct {
+	c   transport.Conn
+	err error
+}
+
+// punchListener accepts the connections of the wrapped listener and the
+// connections punched by its transport.
+type punchListener struct {
+	transport.Listener
+	t *punchTransport
+
+	accepted  chan acceptResult
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *punchListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		select {
+		case l.accepted <- acceptResult{c, err}:
+		case <-l.closed:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (l *punchListener) Accept() (transport.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.c, r.err
+	case c := <-l.t.punched:
+		return c, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *punchListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.t.mux.Lock()
+		l.t.listeners--
+		l.t.mux.Unlock()
+	})
+	return l.Listener.Close()
+}
+
+// transportNetwork is implemented by networks with transports, such as
+// the swarm.
+type transportNetwork interface {
+	TransportForDialing(ma.Multiaddr) transport.Transport
+}
+
+// punchTransportFor returns the punch transport of n dialing addr, or nil.
+func punchTransportFor(n inet.Network, addr ma.Multiaddr) *punchTransport {
+	tn, ok := n.(transportNetwork)
+	if !ok {
+		return nil
+	}
+	t, ok := tn.TransportForDialing(addr).(*punchTransport)
+	if !ok || !t.CanDial(addr) {
+		return nil
+	}
+	return t
+}
+
+// punchDialer dials addresses on the punch transport of the host and waits
+// until the swarm registered the connection. Such dials never touch the
+// dial backoff of the swarm. Addresses of other transports, and all
+// addresses of hosts built without PunchTransport, are dialed through
+// host.Connect, which returns any existing connection; the backoff of the
+// peer is then cleared for the dial and restored after it.
+type punchDialer struct {
+	h       host.Host
+	backoff *backoffScopes
+}
+
+func newPunchDialer(h host.Host) *punchDialer {
+	return &punchDialer{h: h, backoff: newBackoffScopes()}
+}
+
+func (d *punchDialer) DialAddr(ctx context.Context, p peer.ID, addr ma.Multiaddr) error {
+	n := d.h.Network()
+	t := punchTransportFor(n, addr)
+	if t == nil {
+		return d.connect(ctx, p, addr)
+	}
+
+	c, err := t.Dial(ctx, addr, p)
+	if err != nil {
+		return err
+	}
+
+	registered := make(chan struct{})
+	var once sync.Once
+	nb := &inet.NotifyBundle{
+		ConnectedF: func(_ inet.Network, nc inet.Conn) {
+			if nc.RemotePeer() == p &&
+				nc.LocalMultiaddr().Equal(c.LocalMultiaddr()) &&
+				nc.RemoteMultiaddr().Equal(c.RemoteMultiaddr()) {
+				once.Do(func() { close(registered) })
+			}
+		},
+	}
+	n.Notify(nb)
+	defer n.StopNotify(nb)
+
+	if err := t.hand(ctx, c); err != nil {
+		return err
+	}
+	select {
+	case <-registered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connect dials p at addr through the host, within a backoff scope on
+// networks with a dial backoff.
+func (d *punchDialer) connect(ctx context.Context, p peer.ID, addr ma.Multiaddr) error {
+	pi := pstore.PeerInfo{ID: p, Addrs: []ma.Multiaddr{addr}}
+	bn, ok := d.h.Network().(backoffNetwork)
+	if !ok {
+		return d.h.Connect(ctx, pi)
+	}
+
+	bo := bn.Backoff()
+	d.backoff.enter(bo, p)
+	err := d.h.Connect(ctx, pi)
+	d.backoff.exit(bo, p, err == nil)
+	return err
+}
@@ -0,0 +1,207 @@
+package ntraversal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// newPunchHost builds a host with the punch transport listening on the
+// given addresses.
+func newPunchHost(t *testing.T, listen ...string) host.Host {
+	t.Helper()
+
+	sk, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []libp2p.Option{libp2p.Identity(sk), PunchTransport}
+	if len(listen) == 0 {
+		opts = append(opts, libp2p.NoListenAddrs)
+	}
+	for _, a := range listen {
+		opts = append(opts, libp2p.ListenAddrStrings(a))
+	}
+	h, err := libp2p.New(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestPunchDialer(t *testing.T) {
+	a := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+	b := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+	d := newPunchDialer(a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The swarm would return the first connection for the second dial.
+	for i := 1; i <= 2; i++ {
+		if err := d.DialAddr(ctx, b.ID(), b.Addrs()[0]); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(a.Network().ConnsToPeer(b.ID())); n != i {
+			t.Fatalf("dial %d: %d connections, want %d", i, n, i)
+		}
+	}
+
+	// Streams work over punched connections.
+	b.SetStreamHandler("/test", func(s inet.Stream) {
+		s.Write([]byte("ok"))
+		s.Close()
+	})
+	s, err := a.NewStream(ctx, b.ID(), "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestPunchDialerNotListening(t *testing.T) {
+	a := newPunchHost(t)
+	b := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := newPunchDialer(a).DialAddr(ctx, b.ID(), b.Addrs()[0])
+	if err != ErrNotListening {
+		t.Fatalf("got %v, want %v", err, ErrNotListening)
+	}
+}
+
+func TestPunchTransportFor(t *testing.T) {
+	h := newPunchHost(t)
+	mock := newTestTraversal(t, nil)
+
+	cases := []struct {
+		name string
+		h    host.Host
+		addr string
+		want bool
+	}{
+		{"tcp", h, "/ip4/1.2.3.4/tcp/4001", true},
+		{"websocket", h, "/ip4/1.2.3.4/tcp/4001/ws", false},
+		{"relay", h, testRelayAddr, false},
+		{"mocknet", mock.host, "/ip4/1.2.3.4/tcp/4001", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := punchTransportFor(c.h.Network(), ma.StringCast(c.addr)) != nil
+			if got != c.want {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPunchDialerIgnoresBackoff(t *testing.T) {
+	a := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+	b := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+	d := newPunchDialer(a)
+	bo := a.Network().(*swarm.Swarm).Backoff()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A failed punch dial does not back off the peer.
+	closed := newPunchHost(t, "/ip4/127.0.0.1/tcp/0")
+	addr := closed.Addrs()[0]
+	closed.Close()
+	if err := d.DialAddr(ctx, b.ID(), addr); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+	if bo.Backoff(b.ID()) {
+		t.Fatal("failed punch dial backed off the peer")
+	}
+
+	// A backed off peer is still punched to.
+	bo.AddBackoff(b.ID())
+	if err := d.DialAddr(ctx, b.ID(), b.Addrs()[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newPlainHost builds a host with the default transports of libp2p
+// listening on a loopback TCP port.
+func newPlainHost(t *testing.T) host.Host {
+	t.Helper()
+
+	sk, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := libp2p.New(context.Background(),
+		libp2p.Identity(sk),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestDialWithoutPunchTransport(t *testing.T) {
+	a := newPlainHost(t)
+	b := newPlainHost(t)
+	nt, err := NewNatTraversal(context.Background(), a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nt.Close()
+	bo := a.Network().(*swarm.Swarm).Backoff()
+
+	closed := newPlainHost(t)
+	dead := closed.Addrs()[0]
+	closed.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func(addr ma.Multiaddr) error {
+		return nt.Dial(ctx, pstore.PeerInfo{ID: b.ID(), Addrs: []ma.Multiaddr{addr}})
+	}
+
+	// Failed dials neither refuse later ones nor back off the peer.
+	for i := 1; i <= 2; i++ {
+		if err := dial(dead); !errors.Is(err, ErrConnRefused) {
+			t.Fatalf("dial %d: got %v, want %v", i, err, ErrConnRefused)
+		}
+		if bo.Backoff(b.ID()) {
+			t.Fatalf("dial %d backed off the peer", i)
+		}
+	}
+
+	// The backoff of the application is kept when a punch dial fails.
+	bo.AddBackoff(b.ID())
+	if err := dial(dead); !errors.Is(err, ErrConnRefused) {
+		t.Fatalf("got %v, want %v", err, ErrConnRefused)
+	}
+	if !bo.Backoff(b.ID()) {
+		t.Fatal("backoff of the peer lost")
+	}
+
+	if err := dial(b.Addrs()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if bo.Backoff(b.ID()) {
+		t.Fatal("connected peer backed off")
+	}
+}
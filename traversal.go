@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"strings"
+	"io"
 	"sync"
+	"time"
 
 	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
 
@@ -14,11 +15,10 @@ import (
 	iaddr "github.com/ipfs/go-ipfs-addr"
 	logging "github.com/ipfs/go-log"
 	host "github.com/libp2p/go-libp2p-host"
-	dht "github.com/libp2p/go-libp2p-kad-dht"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
-	swarm "github.com/libp2p/go-libp2p-swarm"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var log = logging.Logger("nat-traversal")
@@ -39,17 +39,57 @@ type PacketWPeer struct {
 
 // NatTraversal <TODO>
 type NatTraversal struct {
-	host           *host.Host
+	host           host.Host
 	serviceNodes   []peer.ID
 	bootstrapPeers StreamContainer
 	incoming       chan PacketWPeer
 	outgoing       chan PacketWPeer
-	dht            *dht.IpfsDHT
-	connMap        map[peer.ID]chan error
+	router         PeerRouter
+	connMap        map[peer.ID]*pendingPunch
+	connMux        sync.Mutex
+	cfg            *config
+	events         *eventBus
+	metrics        *metrics
+	stats          *punchStats
+	limiter        *rateLimiter
+	registry       *registry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closeMux sync.Mutex
+	closing  bool
+	closed   bool
+	inflight int
+
+	natMux  sync.Mutex
+	natType NATType
+
+	mappedMux   sync.Mutex
+	mappedAddrs []ma.Multiaddr
+	// portMapDone is closed once the port mappings are removed.
+	portMapDone chan struct{}
+
+	relayWatcher *relayWatcher
+
+	probeMux sync.Mutex
+	probes   map[peer.ID]chan ma.Multiaddr
 }
 
-// NewNatTraversal creates a new bootstraper node.
-func NewNatTraversal(ctx context.Context, host *host.Host, dht *dht.IpfsDHT, opt ...Option) (*NatTraversal, error) {
+// NewNatTraversal creates a new bootstraper node. The router is used to
+// look up peers when coordinating punches and may be nil for clients, but
+// is required with the BootstrapServer option.
+func NewNatTraversal(ctx context.Context, h host.Host, router PeerRouter, opt ...Option) (*NatTraversal, error) {
+	cfg := defaultConfig()
+	if err := cfg.apply(opt...); err != nil {
+		return nil, err
+	}
+	if cfg.serviceNode && router == nil {
+		return nil, fmt.Errorf("a service node needs a peer router")
+	}
+	if cfg.dialer == nil {
+		cfg.dialer = newPunchDialer(h)
+	}
 
 	sc := StreamContainer{
 		mux:      &sync.Mutex{},
@@ -57,19 +97,47 @@ func NewNatTraversal(ctx context.Context, host *host.Host, dht *dht.IpfsDHT, opt
 	}
 
 	b := &NatTraversal{
-		host:           host,
+		host:           h,
 		serviceNodes:   make([]peer.ID, 0),
 		bootstrapPeers: sc,
 		incoming:       make(chan PacketWPeer, 10),
 		outgoing:       make(chan PacketWPeer, 10),
-		dht:            dht,
-		connMap:        make(map[peer.ID]chan error),
+		router:         router,
+		connMap:        make(map[peer.ID]*pendingPunch),
+		cfg:            cfg,
+		events:         newEventBus(),
+		stats:          newPunchStats(),
+		registry:       newRegistry(),
+		probes:         make(map[peer.ID]chan ma.Multiaddr),
 	}
+	b.ctx, b.cancel = context.WithCancel(ctx)
 
-	(*host).SetStreamHandler(protocolBootstrap, b.streamHandler)
+	if cfg.rateLimit > 0 {
+		b.limiter = newRateLimiter(cfg.rateLimit, cfg.rateBurst)
+	}
+
+	b.metrics = newMetrics(b)
+	if cfg.metricsReg != nil {
+		if err := b.metrics.register(cfg.metricsReg); err != nil {
+			return nil, err
+		}
+	}
+
+	h.SetStreamHandler(protocolBootstrap, b.streamHandler)
+
+	if cfg.upgradeRelayed {
+		h.SetStreamHandler(protocolUpgrade, b.upgradeHandler)
+		b.relayWatcher = newRelayWatcher(b)
+		h.Network().Notify(b.relayWatcher)
+	}
 
 	go b.messageHandler()
 
+	if len(cfg.portMappers) > 0 {
+		b.portMapDone = make(chan struct{})
+		go b.portMapLoop(b.ctx)
+	}
+
 	return b, nil
 }
 
@@ -80,13 +148,19 @@ func (b *NatTraversal) ConnectToServiceNodes(ctx context.Context, listPeers []st
 		addr, _ := iaddr.ParseString(peerAddr)
 		peerinfo, _ := pstore.InfoFromP2pAddr(addr.Multiaddr())
 
-		(*b.host).Peerstore().AddAddrs(peerinfo.ID, peerinfo.Addrs, pstore.PermanentAddrTTL)
+		b.host.Peerstore().AddAddrs(peerinfo.ID, peerinfo.Addrs, pstore.PermanentAddrTTL)
 		log.Info("Connecting to: ", peerinfo.ID)
-		if s, err := (*b.host).NewStream(ctx, peerinfo.ID, protocolBootstrap); err == nil {
+		if s, err := b.host.NewStream(ctx, peerinfo.ID, protocolBootstrap); err == nil {
 			log.Info("Connection established with bootstrap node: ", *peerinfo)
 
-			b.setStreamWrapper(s)
+			b.bootstrapPeers.mux.Lock()
 			b.serviceNodes = append(b.serviceNodes, peerinfo.ID)
+			b.bootstrapPeers.mux.Unlock()
+
+			b.setStreamWrapper(s)
+			b.sendRegister(peerinfo.ID)
+
+			b.events.emit(Event{Type: EvtServiceNodeConnected, Peer: peerinfo.ID})
 		} else {
 			log.Error(err)
 		}
@@ -97,7 +171,7 @@ func (b *NatTraversal) setStreamWrapper(s inet.Stream) {
 
 	bw := bufio.NewWriter(s)
 
-	r := ggio.NewDelimitedReader(s, 1<<20)
+	r := ggio.NewDelimitedReader(s, b.cfg.maxMsgSize)
 	w := ggio.NewDelimitedWriter(bw)
 
 	sm := &streamWrapper{
@@ -109,34 +183,129 @@ func (b *NatTraversal) setStreamWrapper(s inet.Stream) {
 
 	b.bootstrapPeers.mux.Lock()
 	b.bootstrapPeers.peerList[s.Conn().RemotePeer()] = sm
+	b.metrics.registeredClients.Set(float64(len(b.bootstrapPeers.peerList)))
 	b.bootstrapPeers.mux.Unlock()
 
-	go sm.readMsg(b.incoming)
+	go func() {
+		err := sm.readMsg(b.incoming, b.ctx.Done())
+		b.removeStreamWrapper(sm, err)
+	}()
+}
+
+// removeStreamWrapper forgets a peer whose stream failed or was closed by
+// the remote. The stream is only removed if it was not replaced meanwhile.
+func (b *NatTraversal) removeStreamWrapper(sm *streamWrapper, err error) {
+	s := *sm.s
+	p := s.Conn().RemotePeer()
+
+	if err == io.EOF {
+		log.Info("Stream closed by: ", p)
+		s.Close()
+	} else {
+		log.Error("Stream to ", p, " failed: ", err)
+		s.Reset()
+	}
+
+	b.bootstrapPeers.mux.Lock()
+	defer b.bootstrapPeers.mux.Unlock()
+
+	if b.bootstrapPeers.peerList[p] != sm {
+		return
+	}
+	delete(b.bootstrapPeers.peerList, p)
+	b.metrics.registeredClients.Set(float64(len(b.bootstrapPeers.peerList)))
+
+	for i, sn := range b.serviceNodes {
+		if sn == p {
+			b.serviceNodes = append(b.serviceNodes[:i], b.serviceNodes[i+1:]...)
+			b.events.emit(Event{Type: EvtServiceNodeDisconnected, Peer: p, Err: err})
+			break
+		}
+	}
+}
+
+func (b *NatTraversal) isServiceNode(p peer.ID) bool {
+	b.bootstrapPeers.mux.Lock()
+	defer b.bootstrapPeers.mux.Unlock()
+
+	for _, sn := range b.serviceNodes {
+		if sn == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *NatTraversal) getStreamWrapper(p peer.ID) (*streamWrapper, bool) {
+	b.bootstrapPeers.mux.Lock()
+	defer b.bootstrapPeers.mux.Unlock()
+
+	sm, ok := b.bootstrapPeers.peerList[p]
+	return sm, ok
 }
 
 // ConnectThroughHolePunching uses a stun server to coordinate a hole punching.
+// The returned channel yields the outcome once. Use Punch to wait for the
+// resulting connection instead.
 func (b *NatTraversal) ConnectThroughHolePunching(ctx context.Context, p peer.ID) (chan error, error) {
+	pp, err := b.requestPunch(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		<-pp.done
+		res <- pp.err
+		close(res)
+	}()
+	return res, nil
+}
+
+// requestPunch asks a service node to coordinate a punch to p. A punch to
+// p which is already in progress is joined instead. The retry policy of
+// ctx is used for the dials of the punch; a joined punch keeps the policy
+// of the caller who started it.
+func (b *NatTraversal) requestPunch(ctx context.Context, p peer.ID) (*pendingPunch, error) {
+	if b.isClosing() {
+		return nil, ErrClosed
+	}
+
+	b.bootstrapPeers.mux.Lock()
 	if len(b.serviceNodes) == 0 {
+		b.bootstrapPeers.mux.Unlock()
 		log.Error("not connected to any service node")
 		return nil, fmt.Errorf("not connected to any service node")
 	}
+	serviceNode := b.serviceNodes[0]
+	b.bootstrapPeers.mux.Unlock()
 
 	log.Info("Conn to peer: ", p)
 
-	// TODO: timer logic: should have a timeout
-	res := make(chan error, 1)
-	b.connMap[p] = res
+	b.connMux.Lock()
+	if pp, ok := b.connMap[p]; ok {
+		pp.waiters++
+		b.connMux.Unlock()
+		return pp, nil
+	}
+	tr := newPunchTrace(p)
+	pp := &pendingPunch{done: make(chan struct{}), trace: tr, retry: b.retryPolicy(ctx), waiters: 1}
+	b.connMap[p] = pp
+	b.connMux.Unlock()
 
-	b.outgoing <- PacketWPeer{
-		peer: b.serviceNodes[0],
+	b.events.emit(Event{Type: EvtPunchRequested, Peer: p})
+	tr.add(TraceStep{Name: StepRequestSent})
+
+	b.send(PacketWPeer{
+		peer: serviceNode,
 		packet: &protocol.Protocol{
 			Type: protocol.Protocol_CONNECTION_REQUEST,
 			PeerID: &protocol.Protocol_PeerID{
 				Id: []byte(peer.IDHexEncode(p)),
 			},
 		},
-	}
-	return res, nil
+	})
+	return pp, nil
 }
 
 func (b *NatTraversal) messageHandler() {
@@ -144,31 +313,139 @@ func (b *NatTraversal) messageHandler() {
 		select {
 		case m := <-b.incoming:
 			log.Info("incoming packet")
-			switch m.packet.Type {
-			case protocol.Protocol_CONNECTION_REQUEST:
-				go b.handleConnectionRequest(m)
-			case protocol.Protocol_HOLE_PUNCH_REQUEST:
-				go b.handleHolePunchRequest(m)
+			if b.registry.isBanned(m.peer) {
+				continue
 			}
+			b.dispatch(m)
 		case o := <-b.outgoing:
 			log.Info("sending out: ", o.peer, o.packet)
-			go b.bootstrapPeers.peerList[o.peer].writeMsg(o.packet)
+			sm, ok := b.getStreamWrapper(o.peer)
+			if !ok {
+				log.Error("no stream to peer: ", o.peer)
+				continue
+			}
+			go sm.writeMsg(o.packet)
+		case <-b.ctx.Done():
+			return
 		}
 	}
 }
 
+// send queues a packet for the message handler. It is dropped once b is
+// closed.
+func (b *NatTraversal) send(m PacketWPeer) {
+	select {
+	case b.outgoing <- m:
+	case <-b.ctx.Done():
+	}
+}
+
+// dispatch hands a packet to its handler. Packets which are malformed are
+// answered with an error message instead.
+func (b *NatTraversal) dispatch(m PacketWPeer) {
+	if err := validatePacket(m.packet); err != nil {
+		log.Error("invalid packet from ", m.peer, ": ", err)
+		// Invalid errors are not answered, two peers would bounce them.
+		if m.packet.Type != protocol.Protocol_ERROR {
+			b.sendErrMessage(m.peer, "", err)
+		}
+		return
+	}
+
+	switch m.packet.Type {
+	case protocol.Protocol_CONNECTION_REQUEST:
+		b.track(b.handleConnectionRequest, m)
+	case protocol.Protocol_HOLE_PUNCH_REQUEST:
+		b.track(b.handleHolePunchRequest, m)
+	case protocol.Protocol_PEER_UNKNOWN:
+		b.track(b.handlePeerUnknown, m)
+	case protocol.Protocol_PUNCH_RESULT:
+		b.track(b.handlePunchResult, m)
+	case protocol.Protocol_REGISTER:
+		b.track(b.handleRegister, m)
+	case protocol.Protocol_NAT_PROBE:
+		b.track(b.handleNATProbe, m)
+	case protocol.Protocol_ERROR:
+		b.track(b.handleError, m)
+	}
+}
+
+// validatePacket checks that a packet carries the fields its type needs,
+// so handlers can dereference them.
+func validatePacket(pkt *protocol.Protocol) error {
+	switch pkt.Type {
+	case protocol.Protocol_CONNECTION_REQUEST, protocol.Protocol_PEER_UNKNOWN:
+		if pkt.PeerID == nil {
+			return fmt.Errorf("%s without peer id", pkt.Type)
+		}
+		if _, err := peer.IDHexDecode(string(pkt.PeerID.Id)); err != nil {
+			return fmt.Errorf("%s with invalid peer id: %s", pkt.Type, err)
+		}
+	case protocol.Protocol_HOLE_PUNCH_REQUEST, protocol.Protocol_REGISTER:
+		if pkt.PeerInfo == nil {
+			return fmt.Errorf("%s without peer info", pkt.Type)
+		}
+	case protocol.Protocol_PUNCH_RESULT:
+		if pkt.PunchResult == nil {
+			return fmt.Errorf("%s without result", pkt.Type)
+		}
+	case protocol.Protocol_NAT_PROBE:
+		if pkt.PeerInfo != nil && len(pkt.PeerInfo.Observed) != 1 {
+			return fmt.Errorf("%s answer without observed address", pkt.Type)
+		}
+	case protocol.Protocol_ERROR:
+		if pkt.Error == nil {
+			return fmt.Errorf("%s without error", pkt.Type)
+		}
+		if pkt.PeerID != nil {
+			if _, err := peer.IDHexDecode(string(pkt.PeerID.Id)); err != nil {
+				return fmt.Errorf("%s with invalid peer id: %s", pkt.Type, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown packet type: %d", pkt.Type)
+	}
+	return nil
+}
+
 func (b *NatTraversal) handleConnectionRequest(m PacketWPeer) {
 	id, _ := peer.IDHexDecode(string(m.packet.PeerID.Id))
 	log.Info("Got a connection request to: ", id)
 
+	if !b.cfg.serviceNode {
+		b.sendErrMessage(m.peer, id, fmt.Errorf("not a service node"))
+		return
+	}
+	if b.isClosing() {
+		b.sendErrMessage(m.peer, id, fmt.Errorf("shutting down"))
+		return
+	}
+	if b.cfg.authorize != nil && !b.cfg.authorize(m.peer) {
+		log.Info("Rejecting connection request from unauthorized peer: ", m.peer)
+		b.sendErrMessage(m.peer, id, fmt.Errorf("not authorized"))
+		return
+	}
+	if b.limiter != nil && !b.limiter.allow(m.peer) {
+		log.Info("Rate limiting connection request from: ", m.peer)
+		b.sendErrMessage(m.peer, id, fmt.Errorf("rate limited"))
+		return
+	}
+
+	b.metrics.connRequests.Inc()
+	b.registry.startCoordination(m.peer, id)
+
 	//host := *b.host
 
+	// Both sides get the same order as they run the strategies in step.
+	order := b.strategyOrder(m.peer, id)
+
 	piInitiator, err := b.findPeerInfo(m.peer)
 	if err != nil {
 		log.Error(err)
-		b.sendErrMessage(err)
+		b.sendErrMessage(m.peer, id, err)
 		return
 	}
+	piInitiator.Strategies = order
 	b.sendPunchRequest(id, piInitiator)
 
 	//time.Sleep(time.Millisecond * 500)
@@ -176,96 +453,328 @@ func (b *NatTraversal) handleConnectionRequest(m PacketWPeer) {
 	piNonInit, err := b.findPeerInfo(id)
 	if err != nil {
 		log.Error(err)
-		b.sendErrMessage(err)
+		b.sendPeerUnknown(m.peer, id)
 		return
 	}
+	piNonInit.Strategies = order
 	b.sendPunchRequest(m.peer, piNonInit)
 }
 
-func (b *NatTraversal) findPeerInfo(p peer.ID) ([]byte, error) {
-	pi, err := b.dht.FindPeer(context.Background(), p)
+func (b *NatTraversal) findPeerInfo(p peer.ID) (*protocol.Protocol_PeerInfo, error) {
+	start := time.Now()
+	pi, err := b.router.FindPeer(b.ctx, p)
+	b.metrics.dhtLookupDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		log.Error(err)
+		b.metrics.dhtLookups.WithLabelValues("failure").Inc()
 		return nil, fmt.Errorf("Could not find a peer")
 	}
-	piPublic := pstore.PeerInfo{}
-	for _, addr := range pi.Addrs {
-		// hacky way to remove all loopback and private addresses
-		// should be removed
-		if strings.Contains(addr.String(), "127.") ||
-			strings.Contains(addr.String(), "192.") ||
-			strings.Contains(addr.String(), "10.") ||
-			strings.Contains(addr.String(), "p2p-circuit") {
-			continue
+	b.metrics.dhtLookups.WithLabelValues("success").Inc()
+	piPublic := pstore.PeerInfo{
+		ID:    pi.ID,
+		Addrs: publicAddrs(pi.Addrs),
+	}
+
+	// The addresses p is connected to us from carry a live NAT mapping.
+	var observed [][]byte
+	for _, c := range b.host.Network().ConnsToPeer(p) {
+		for _, addr := range publicAddrs([]ma.Multiaddr{c.RemoteMultiaddr()}) {
+			observed = append(observed, addr.Bytes())
+			if !containsAddr(piPublic.Addrs, addr) {
+				piPublic.Addrs = append(piPublic.Addrs, addr)
+			}
 		}
-		piPublic.Addrs = append(piPublic.Addrs, addr)
 	}
-	piPublic.ID = pi.ID
+
 	data, err := piPublic.MarshalJSON()
 	if err != nil {
 		log.Error(err)
 		return nil, fmt.Errorf("cannot marshal peerinfo")
 	}
 
-	return data, nil
+	return &protocol.Protocol_PeerInfo{
+		Info:     data,
+		Observed: observed,
+	}, nil
+}
+
+func containsAddr(addrs []ma.Multiaddr, addr ma.Multiaddr) bool {
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddrs returns the addresses of addrs which are neither relayed nor
+// on an IP which is not public. Addresses without an IP, such as DNS ones,
+// are kept.
+func publicAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	var public []ma.Multiaddr
+	for _, addr := range addrs {
+		if isRelayAddr(addr) {
+			continue
+		}
+		if ip := addrIP(addr); ip != nil && !isPublicIP(ip) {
+			continue
+		}
+		public = append(public, addr)
+	}
+	return public
+}
+
+func (b *NatTraversal) sendPunchRequest(to peer.ID, pi *protocol.Protocol_PeerInfo) {
+	b.metrics.punchInstructions.Inc()
+
+	b.send(PacketWPeer{
+		peer: to,
+		packet: &protocol.Protocol{
+			Type:     protocol.Protocol_HOLE_PUNCH_REQUEST,
+			PeerInfo: pi,
+		},
+	})
+}
+
+// sendErrMessage tells to that its message could not be handled. target
+// is the peer to punch to if the message was about a punch, which fails
+// the punch on the side of to, and empty otherwise.
+func (b *NatTraversal) sendErrMessage(to, target peer.ID, err error) {
+	pkt := &protocol.Protocol{
+		Type: protocol.Protocol_ERROR,
+		Error: &protocol.Protocol_Error{
+			Message: err.Error(),
+		},
+	}
+	if target != "" {
+		pkt.PeerID = &protocol.Protocol_PeerID{
+			Id: []byte(peer.IDHexEncode(target)),
+		}
+	}
+	b.send(PacketWPeer{peer: to, packet: pkt})
+}
+
+// handleError fails the punch an error message of a service node is
+// about. Other errors are only logged.
+func (b *NatTraversal) handleError(m PacketWPeer) {
+	log.Error("error from ", m.peer, ": ", m.packet.Error.Message)
+
+	if m.packet.PeerID == nil || !b.isServiceNode(m.peer) {
+		return
+	}
+	id, _ := peer.IDHexDecode(string(m.packet.PeerID.Id))
+
+	b.pendingTrace(id).add(TraceStep{Name: StepServiceNodeError})
+	b.resolvePending(id, fmt.Errorf("service node %s: %s", m.peer.Pretty(), m.packet.Error.Message))
 }
 
-func (b *NatTraversal) sendPunchRequest(to peer.ID, pi []byte) {
-	b.outgoing <- PacketWPeer{
+func (b *NatTraversal) sendPeerUnknown(to peer.ID, p peer.ID) {
+	b.send(PacketWPeer{
 		peer: to,
 		packet: &protocol.Protocol{
-			Type: protocol.Protocol_HOLE_PUNCH_REQUEST,
-			PeerInfo: &protocol.Protocol_PeerInfo{
-				Info: pi,
+			Type: protocol.Protocol_PEER_UNKNOWN,
+			PeerID: &protocol.Protocol_PeerID{
+				Id: []byte(peer.IDHexEncode(p)),
 			},
 		},
+	})
+}
+
+func (b *NatTraversal) handlePeerUnknown(m PacketWPeer) {
+	if !b.isServiceNode(m.peer) {
+		log.Info("Dropping peer unknown from a peer which is not a service node: ", m.peer)
+		return
 	}
+	id, _ := peer.IDHexDecode(string(m.packet.PeerID.Id))
+	log.Info("Service node could not find: ", id)
+
+	b.pendingTrace(id).add(TraceStep{Name: StepPeerUnknown})
+	b.resolvePending(id, fmt.Errorf("service node %s could not find peer %s", m.peer.Pretty(), id.Pretty()))
 }
 
-func (b *NatTraversal) sendErrMessage(err error) {}
+// pendingPunch is a punch we requested. done is closed once result or
+// err is set.
+type pendingPunch struct {
+	done  chan struct{}
+	trace *punchTrace
+	retry RetryPolicy
+	// waiters counts the callers waiting for the punch, guarded by
+	// connMux.
+	waiters int
+	result  *PunchResult
+	err     error
+}
+
+// pending returns the punch we requested to p, or nil.
+func (b *NatTraversal) pending(p peer.ID) *pendingPunch {
+	b.connMux.Lock()
+	defer b.connMux.Unlock()
+	return b.connMap[p]
+}
+
+// pendingTrace returns the trace of the punch we requested to p, or nil.
+func (b *NatTraversal) pendingTrace(p peer.ID) *punchTrace {
+	if pp := b.pending(p); pp != nil {
+		return pp.trace
+	}
+	return nil
+}
+
+// resolvePending reports the outcome of a punch we requested. Errors are
+// returned as *PunchError carrying the trace. It is a no-op for punches we
+// did not request.
+func (b *NatTraversal) resolvePending(p peer.ID, err error) {
+	b.connMux.Lock()
+	pp, ok := b.connMap[p]
+	delete(b.connMap, p)
+	b.connMux.Unlock()
+
+	if ok {
+		b.finishPunch(p, pp, err)
+	}
+}
+
+// leavePunch stops waiting for pp. The last caller to leave fails pp with
+// err unless it finished already. It returns false if other callers still
+// wait for pp, which then keeps running.
+func (b *NatTraversal) leavePunch(p peer.ID, pp *pendingPunch, err error) bool {
+	b.connMux.Lock()
+	ok := b.connMap[p] == pp
+	if ok && pp.waiters > 1 {
+		pp.waiters--
+		b.connMux.Unlock()
+		return false
+	}
+	if ok {
+		delete(b.connMap, p)
+	}
+	b.connMux.Unlock()
+
+	if ok {
+		b.finishPunch(p, pp, err)
+	}
+	return true
+}
 
+// finishPunch sets the outcome of pp, which must have been removed from
+// the pending punches, and exports its trace.
+func (b *NatTraversal) finishPunch(p peer.ID, pp *pendingPunch, err error) {
+	// Punches which failed before or while the pipeline ran have no
+	// outcome yet.
+	pp.trace.finish("", 0, err)
+	res := pp.trace.result()
+	if err != nil {
+		pp.err = &PunchError{Result: res, Err: err}
+	} else {
+		res.Conn = b.punchedConn(p)
+		if res.Conn != nil {
+			res.Addr = res.Conn.RemoteMultiaddr()
+			res.Transport = transportOf(res.Addr)
+		}
+		pp.result = res
+	}
+	b.exportTrace(res, err)
+	close(pp.done)
+}
+
+// handleHolePunchRequest runs the pipeline to the peer a service node
+// asked us to punch to. Requests of other peers are dropped, they would
+// make us dial addresses of their choosing.
 func (b *NatTraversal) handleHolePunchRequest(m PacketWPeer) {
+	if !b.isServiceNode(m.peer) {
+		log.Info("Dropping punch request from a peer which is not a service node: ", m.peer)
+		return
+	}
+
 	pi := pstore.PeerInfo{}
-	pi.UnmarshalJSON(m.packet.PeerInfo.Info)
+	if err := pi.UnmarshalJSON(m.packet.PeerInfo.Info); err != nil {
+		log.Error("invalid peer info from ", m.peer, ": ", err)
+		b.sendErrMessage(m.peer, "", fmt.Errorf("invalid peer info: %s", err))
+		return
+	}
+	if pi.ID == "" {
+		b.sendErrMessage(m.peer, "", fmt.Errorf("peer info without peer id"))
+		return
+	}
 
 	log.Info("Got punch request to: ", pi)
 
-	cleanup := func() {
-		close(b.connMap[pi.ID])
-		delete(b.connMap, pi.ID)
+	start := time.Now()
+
+	// Punches requested by the other peer are traced for export only and
+	// use the configured retry policy.
+	tr, retry := newPunchTrace(pi.ID), b.cfg.retry
+	pp := b.pending(pi.ID)
+	if pp != nil {
+		tr, retry = pp.trace, pp.retry
 	}
+	tr.add(TraceStep{Name: StepInstructionReceived, Duration: start.Sub(tr.start), Addrs: pi.Addrs})
 
-	cnt := 3
-	var err error
-	for i := 0; i < cnt; i++ {
-		err = (*b.host).Connect(context.Background(), pi)
-		if err == nil {
-			log.Info(i+1, "trial succeeded.", err)
-			break
+	b.events.emit(Event{Type: EvtPunchInstructionReceived, Peer: pi.ID, Addrs: pi.Addrs})
+
+	var observed []ma.Multiaddr
+	for _, raw := range m.packet.PeerInfo.Observed {
+		if addr, err := ma.NewMultiaddrBytes(raw); err == nil {
+			observed = append(observed, addr)
 		}
-		(*b.host).Network().(*swarm.Swarm).Backoff().Clear(pi.ID)
+	}
+	ctx := withObservedAddrs(b.ctx, observed)
+	ctx = withTrace(ctx, tr)
+	ctx = WithRetryPolicy(ctx, retry)
 
-		log.Error(err)
+	strategy, attempts, err := b.runPipeline(ctx, pi, m.packet.PeerInfo.Strategies)
 
-		if strings.Contains(err.Error(), "no route to host") {
-			log.Info("Delay", err)
-			//time.Sleep(time.Second * 10)
-		}
+	elapsed := time.Since(start)
+	tr.finish(strategy, attempts, err)
+	if pp == nil {
+		// Punches we requested are exported once they finished.
+		b.exportTrace(tr.result(), err)
+	}
 
-		log.Error(i+1, "Failed")
+	res := &protocol.Protocol_PunchResult{
+		Success:   err == nil,
+		PeerID:    []byte(peer.IDHexEncode(pi.ID)),
+		ElapsedMs: int64(elapsed / time.Millisecond),
+		Attempts:  int32(attempts),
+		NatType:   b.NATType().String(),
+		Strategy:  strategy,
 	}
 
 	if err != nil {
 		log.Error("All attempts Failed")
-		b.connMap[pi.ID] <- err
+		b.metrics.punchResults.WithLabelValues("failure", dialFailureReason(err), dialFailureTransport(err, pi.Addrs)).Inc()
+		res.Error = err.Error()
+		b.sendPunchResult(m.peer, res)
+		b.resolvePending(pi.ID, err)
 	} else {
-		b.connMap[pi.ID] <- nil
+		// Relayed connections stay open next to the punched one.
+		var remoteAddr ma.Multiaddr
+		if c := b.punchedConn(pi.ID); c != nil {
+			remoteAddr = c.RemoteMultiaddr()
+			res.Addr = remoteAddr.Bytes()
+		}
+		res.Transport = transportOf(remoteAddr)
+		if strategy != (Relay{}).Name() {
+			b.events.emit(Event{Type: EvtDirectConnEstablished, Peer: pi.ID, Attempt: attempts, Addrs: []ma.Multiaddr{remoteAddr}, Strategy: strategy})
+		}
+		b.metrics.punchResults.WithLabelValues("success", "", res.Transport).Inc()
+		b.metrics.timeToConnect.Observe(elapsed.Seconds())
+		b.sendPunchResult(m.peer, res)
+		b.resolvePending(pi.ID, nil)
 	}
-
-	cleanup()
 }
 
 func (b *NatTraversal) streamHandler(s inet.Stream) {
+	if b.isClosing() {
+		s.Reset()
+		return
+	}
+	if b.registry.isBanned(s.Conn().RemotePeer()) {
+		log.Info("Refusing stream from banned peer: ", s.Conn().RemotePeer())
+		s.Reset()
+		return
+	}
+
 	log.Info("Connected to: ", s.Conn().RemotePeer())
 	b.setStreamWrapper(s)
 }
@@ -0,0 +1,494 @@
+package ntraversal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	ggio "github.com/gogo/protobuf/io"
+	proto "github.com/golang/protobuf/proto"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	tu "github.com/libp2p/go-libp2p-peer/test"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	protocol "github.com/upperwal/go-libp2p-nat-traversal/protocol"
+)
+
+// stubRouter finds the peers it was given.
+type stubRouter map[peer.ID]pstore.PeerInfo
+
+func (r stubRouter) FindPeer(ctx context.Context, p peer.ID) (pstore.PeerInfo, error) {
+	if pi, ok := r[p]; ok {
+		return pi, nil
+	}
+	return pstore.PeerInfo{}, ErrPeerNotFound
+}
+
+// newTestTraversal runs traversal on a host of a fresh mock network.
+func newTestTraversal(t *testing.T, router PeerRouter, opts ...Option) *NatTraversal {
+	t.Helper()
+	return newTestTraversalOn(t, mocknet.New(context.Background()), router, opts...)
+}
+
+// newTestTraversalOn runs traversal on a new host of mn.
+func newTestTraversalOn(t *testing.T, mn mocknet.Mocknet, router PeerRouter, opts ...Option) *NatTraversal {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewNatTraversal(ctx, h, router, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Close()
+		h.Close()
+	})
+	return b
+}
+
+// newTestClient runs a client registered with the service node sn, which
+// must run on mn.
+func newTestClient(t *testing.T, mn mocknet.Mocknet, sn *NatTraversal, opts ...Option) *NatTraversal {
+	t.Helper()
+
+	c := newTestTraversalOn(t, mn, nil, opts...)
+	if _, err := mn.LinkPeers(c.host.ID(), sn.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("%s/ipfs/%s", sn.host.Addrs()[0], sn.host.ID().Pretty())
+	c.ConnectToServiceNodes(context.Background(), []string{addr})
+	if len(c.ServiceNodes()) == 0 {
+		t.Fatal("client did not connect to the service node")
+	}
+	return c
+}
+
+// testPeer returns a random peer ID.
+func testPeer(t *testing.T) peer.ID {
+	t.Helper()
+
+	p, err := tu.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func hexID(p peer.ID) *protocol.Protocol_PeerID {
+	return &protocol.Protocol_PeerID{Id: []byte(peer.IDHexEncode(p))}
+}
+
+func TestValidatePacket(t *testing.T) {
+	p := testPeer(t)
+	bad := &protocol.Protocol_PeerID{Id: []byte("not hex")}
+	info := &protocol.Protocol_PeerInfo{}
+
+	cases := []struct {
+		name  string
+		pkt   *protocol.Protocol
+		valid bool
+	}{
+		{"connection request", &protocol.Protocol{Type: protocol.Protocol_CONNECTION_REQUEST, PeerID: hexID(p)}, true},
+		{"connection request without id", &protocol.Protocol{Type: protocol.Protocol_CONNECTION_REQUEST}, false},
+		{"connection request with bad id", &protocol.Protocol{Type: protocol.Protocol_CONNECTION_REQUEST, PeerID: bad}, false},
+		{"peer unknown without id", &protocol.Protocol{Type: protocol.Protocol_PEER_UNKNOWN}, false},
+		{"punch request", &protocol.Protocol{Type: protocol.Protocol_HOLE_PUNCH_REQUEST, PeerInfo: info}, true},
+		{"punch request without info", &protocol.Protocol{Type: protocol.Protocol_HOLE_PUNCH_REQUEST}, false},
+		{"register without info", &protocol.Protocol{Type: protocol.Protocol_REGISTER}, false},
+		{"punch result without result", &protocol.Protocol{Type: protocol.Protocol_PUNCH_RESULT}, false},
+		{"nat probe", &protocol.Protocol{Type: protocol.Protocol_NAT_PROBE}, true},
+		{"nat probe answer without address", &protocol.Protocol{Type: protocol.Protocol_NAT_PROBE, PeerInfo: info}, false},
+		{"error", &protocol.Protocol{Type: protocol.Protocol_ERROR, Error: &protocol.Protocol_Error{}}, true},
+		{"error about a punch", &protocol.Protocol{Type: protocol.Protocol_ERROR, Error: &protocol.Protocol_Error{}, PeerID: hexID(p)}, true},
+		{"error with bad id", &protocol.Protocol{Type: protocol.Protocol_ERROR, Error: &protocol.Protocol_Error{}, PeerID: bad}, false},
+		{"error without error", &protocol.Protocol{Type: protocol.Protocol_ERROR}, false},
+		{"unknown type", &protocol.Protocol{Type: 42}, false},
+	}
+	for _, c := range cases {
+		if err := validatePacket(c.pkt); (err == nil) != c.valid {
+			t.Errorf("%s: got %v, want valid=%v", c.name, err, c.valid)
+		}
+	}
+}
+
+// checkValid fails if a handler would dereference a missing field of a
+// packet validatePacket accepted.
+func checkValid(t *testing.T, pkt *protocol.Protocol) {
+	if validatePacket(pkt) != nil {
+		return
+	}
+	switch pkt.Type {
+	case protocol.Protocol_CONNECTION_REQUEST, protocol.Protocol_PEER_UNKNOWN:
+		if pkt.PeerID == nil {
+			t.Fatalf("accepted %s without peer id", pkt.Type)
+		}
+	case protocol.Protocol_HOLE_PUNCH_REQUEST, protocol.Protocol_REGISTER:
+		if pkt.PeerInfo == nil {
+			t.Fatalf("accepted %s without peer info", pkt.Type)
+		}
+	case protocol.Protocol_PUNCH_RESULT:
+		if pkt.PunchResult == nil {
+			t.Fatalf("accepted %s without result", pkt.Type)
+		}
+	case protocol.Protocol_ERROR:
+		if pkt.Error == nil {
+			t.Fatalf("accepted %s without error", pkt.Type)
+		}
+	}
+}
+
+func seedPackets(f *testing.F) {
+	p, err := tu.RandPeerID()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, pkt := range []*protocol.Protocol{
+		{Type: protocol.Protocol_CONNECTION_REQUEST, PeerID: hexID(p)},
+		{Type: protocol.Protocol_HOLE_PUNCH_REQUEST, PeerInfo: &protocol.Protocol_PeerInfo{Info: []byte("{}")}},
+		{Type: protocol.Protocol_PUNCH_RESULT, PunchResult: &protocol.Protocol_PunchResult{Success: true, NatType: "Symmetric"}},
+		{Type: protocol.Protocol_ERROR, Error: &protocol.Protocol_Error{Message: "rate limited"}, PeerID: hexID(p)},
+	} {
+		data, err := proto.Marshal(pkt)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzValidatePacket(f *testing.F) {
+	seedPackets(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkt := &protocol.Protocol{}
+		if err := proto.Unmarshal(data, pkt); err != nil {
+			return
+		}
+		checkValid(t, pkt)
+	})
+}
+
+// fakeStream is a stream whose only working method is Conn.
+type fakeStream struct {
+	inet.Stream
+	remote peer.ID
+}
+
+func (s fakeStream) Conn() inet.Conn { return fakeConn{remote: s.remote} }
+
+type fakeConn struct {
+	inet.Conn
+	remote peer.ID
+}
+
+func (c fakeConn) RemotePeer() peer.ID { return c.remote }
+
+func FuzzReadMsg(f *testing.F) {
+	seedPackets(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// the seeds are single packets, frame them like the writer does
+		var buf bytes.Buffer
+		w := ggio.NewDelimitedWriter(&buf)
+		pkt := &protocol.Protocol{}
+		if proto.Unmarshal(data, pkt) == nil {
+			w.WriteMsg(pkt)
+		}
+		buf.Write(data)
+
+		var s inet.Stream = fakeStream{remote: "remote"}
+		r := ggio.NewDelimitedReader(&buf, 1<<12)
+		sw := &streamWrapper{s: &s, r: &r}
+
+		incoming := make(chan PacketWPeer)
+		done := make(chan error)
+		go func() { done <- sw.readMsg(incoming, nil) }()
+
+		for {
+			select {
+			case m := <-incoming:
+				if m.peer != "remote" || m.packet == nil {
+					t.Fatalf("bad packet %+v", m)
+				}
+				checkValid(t, m.packet)
+			case err := <-done:
+				if err == nil {
+					t.Fatal("readMsg returned without error")
+				}
+				return
+			}
+		}
+	})
+}
+
+func TestReadMsgDistinctPackets(t *testing.T) {
+	p := testPeer(t)
+	sent := []*protocol.Protocol{
+		{Type: protocol.Protocol_CONNECTION_REQUEST, PeerID: hexID(p)},
+		{Type: protocol.Protocol_ERROR, Error: &protocol.Protocol_Error{Message: "rate limited"}},
+	}
+	var buf bytes.Buffer
+	w := ggio.NewDelimitedWriter(&buf)
+	for _, pkt := range sent {
+		if err := w.WriteMsg(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var s inet.Stream = fakeStream{remote: "remote"}
+	r := ggio.NewDelimitedReader(&buf, 1<<12)
+	sw := &streamWrapper{s: &s, r: &r}
+
+	incoming := make(chan PacketWPeer, len(sent))
+	if err := sw.readMsg(incoming, nil); err != io.EOF {
+		t.Fatalf("readMsg returned %v, want EOF", err)
+	}
+	first, second := <-incoming, <-incoming
+	if first.packet == second.packet {
+		t.Fatal("both messages read into the same packet")
+	}
+	// The second message must not have been decoded into the first.
+	for i, m := range []PacketWPeer{first, second} {
+		if !proto.Equal(m.packet, sent[i]) {
+			t.Fatalf("message %d read as %v, want %v", i, m.packet, sent[i])
+		}
+	}
+}
+
+func TestHandleErrorResolvesPending(t *testing.T) {
+	b := newTestTraversal(t, nil)
+	sn, target := testPeer(t), testPeer(t)
+	b.serviceNodes = []peer.ID{sn}
+
+	pp, err := b.requestPunch(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// errors from peers which are not our service nodes are ignored
+	b.handleError(PacketWPeer{
+		peer: testPeer(t),
+		packet: &protocol.Protocol{
+			Type:   protocol.Protocol_ERROR,
+			Error:  &protocol.Protocol_Error{Message: "go away"},
+			PeerID: hexID(target),
+		},
+	})
+	select {
+	case <-pp.done:
+		t.Fatal("punch failed on an error of a stranger")
+	default:
+	}
+
+	b.handleError(PacketWPeer{
+		peer: sn,
+		packet: &protocol.Protocol{
+			Type:   protocol.Protocol_ERROR,
+			Error:  &protocol.Protocol_Error{Message: "rate limited"},
+			PeerID: hexID(target),
+		},
+	})
+	<-pp.done
+
+	perr, ok := pp.err.(*PunchError)
+	if !ok {
+		t.Fatalf("got %T %v, want *PunchError", pp.err, pp.err)
+	}
+	if !strings.Contains(perr.Error(), "rate limited") {
+		t.Errorf("error %q does not carry the message", perr)
+	}
+	if steps := perr.Result.Trace; len(steps) < 2 || steps[len(steps)-2].Name != StepServiceNodeError || steps[len(steps)-1].Name != StepOutcome {
+		t.Errorf("trace %v does not end with the service node error and the outcome", steps)
+	}
+
+	again, err := b.requestPunch(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == pp {
+		t.Fatal("new punch joined the failed one")
+	}
+}
+
+func TestPunchJoined(t *testing.T) {
+	b := newTestTraversal(t, nil)
+	target := testPeer(t)
+	b.serviceNodes = []peer.ID{testPeer(t)}
+
+	first, cancelFirst := context.WithCancel(WithRetryPolicy(context.Background(), RetryPolicy{MaxAttempts: 1}))
+	defer cancelFirst()
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := b.Punch(first, target)
+		firstDone <- err
+	}()
+	var pp *pendingPunch
+	for pp == nil {
+		time.Sleep(time.Millisecond)
+		pp = b.pending(target)
+	}
+
+	// A joining caller leaving does not abandon the punch of the first.
+	joined, cancelJoined := context.WithTimeout(WithRetryPolicy(context.Background(), RetryPolicy{MaxAttempts: 7}), 10*time.Millisecond)
+	defer cancelJoined()
+	if _, err := b.Punch(joined, target); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("joined punch returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case err := <-firstDone:
+		t.Fatalf("punch of the first caller returned %v", err)
+	default:
+	}
+	if b.pending(target) != pp {
+		t.Fatal("punch abandoned by a joining caller")
+	}
+	if pp.retry.MaxAttempts != 1 {
+		t.Fatalf("punch with %d attempts, want the policy of the first caller", pp.retry.MaxAttempts)
+	}
+
+	// The last caller leaving abandons it.
+	cancelFirst()
+	if err := <-firstDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if b.pending(target) != nil {
+		t.Fatal("punch still pending after all callers left")
+	}
+}
+
+func TestStrangerPacketsIgnored(t *testing.T) {
+	sn, stranger, target := testPeer(t), testPeer(t), testPeer(t)
+	info, err := pstore.PeerInfo{ID: target}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		from peer.ID
+		want bool
+	}{
+		{"stranger", stranger, false},
+		{"service node", sn, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			st := blockingStrategy{started: make(chan struct{})}
+			b := newTestTraversal(t, nil, Pipeline(Stage{Strategy: st, Timeout: 100 * time.Millisecond}))
+			b.serviceNodes = []peer.ID{sn}
+
+			pp, err := b.requestPunch(context.Background(), target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.handlePeerUnknown(PacketWPeer{
+				peer:   c.from,
+				packet: &protocol.Protocol{Type: protocol.Protocol_PEER_UNKNOWN, PeerID: hexID(target)},
+			})
+			select {
+			case <-pp.done:
+				if !c.want {
+					t.Fatal("punch failed on a peer unknown of a stranger")
+				}
+			default:
+				if c.want {
+					t.Fatal("punch still pending after a peer unknown of the service node")
+				}
+			}
+
+			b.handleHolePunchRequest(PacketWPeer{
+				peer: c.from,
+				packet: &protocol.Protocol{
+					Type:     protocol.Protocol_HOLE_PUNCH_REQUEST,
+					PeerInfo: &protocol.Protocol_PeerInfo{Info: info},
+				},
+			})
+			select {
+			case <-st.started:
+				if !c.want {
+					t.Fatal("punched on a request of a stranger")
+				}
+			default:
+				if c.want {
+					t.Fatal("request of the service node not punched")
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionRequestRejected(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []Option
+		// burst punches once first to use up the burst of the rate limit
+		burst bool
+		want  string
+	}{
+		{"not a service node", nil, false, "not a service node"},
+		{"unauthorized", []Option{BootstrapServer, Authorize(func(peer.ID) bool { return false })}, false, "not authorized"},
+		{"rate limited", []Option{BootstrapServer, RateLimit(0.001, 1)}, true, "rate limited"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mn := mocknet.New(context.Background())
+			// a client with a router must still refuse to coordinate
+			sn := newTestTraversalOn(t, mn, stubRouter{}, c.opts...)
+			client := newTestClient(t, mn, sn)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if c.burst {
+				client.Punch(ctx, testPeer(t))
+			}
+			_, err := client.Punch(ctx, testPeer(t))
+			if _, ok := err.(*PunchError); !ok || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("got %T %v, want a *PunchError with %q", err, err, c.want)
+			}
+		})
+	}
+}
+
+func TestPublicAddrs(t *testing.T) {
+	cases := []struct {
+		addr   string
+		public bool
+	}{
+		{"/ip4/1.192.0.1/tcp/4001", true},
+		{"/ip4/110.0.0.1/tcp/4001", true},
+		{"/ip4/210.0.0.1/tcp/4001", true},
+		{"/ip4/203.0.113.7/udp/4001", true},
+		{"/ip6/2001:db8::1/tcp/4001", true},
+		{"/dns4/example.com/tcp/4001", true},
+		{"/ip4/127.0.0.1/tcp/4001", false},
+		{"/ip4/10.0.0.1/tcp/4001", false},
+		{"/ip4/172.16.0.1/tcp/4001", false},
+		{"/ip4/192.168.1.1/tcp/4001", false},
+		{"/ip4/169.254.0.1/tcp/4001", false},
+		{"/ip4/100.64.0.1/tcp/4001", false},
+		{"/ip4/0.0.0.0/tcp/4001", false},
+		{"/ip6/::1/tcp/4001", false},
+		{"/ip6/fd00::1/tcp/4001", false},
+		{"/ip6/fe80::1/tcp/4001", false},
+		{"/ip4/203.0.113.7/tcp/4001/ipfs/QmQnAZsyiJSovuqg8zjP3nKdm6Pwb75Mpn8HnGyD5WYZ15/p2p-circuit", false},
+	}
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			public := len(publicAddrs(mustAddrs(t, []string{c.addr}))) == 1
+			if public != c.public {
+				t.Fatalf("public %v, want %v", public, c.public)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package ntraversal
+
+import (
+	"context"
+	"fmt"
+
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// traversalHost falls back to coordinated hole punching when a peer
+// cannot be dialed directly.
+type traversalHost struct {
+	host.Host
+	nt *NatTraversal
+}
+
+// WrapHost returns a host whose Connect and NewStream punch a hole through
+// a service node of nt when dialing a peer fails, and then retry the
+// original operation. nt must have been created for h.
+func WrapHost(h host.Host, nt *NatTraversal) host.Host {
+	return &traversalHost{
+		Host: h,
+		nt:   nt,
+	}
+}
+
+// Connect implements host.Host.
+func (th *traversalHost) Connect(ctx context.Context, pi pstore.PeerInfo) error {
+	err := th.Host.Connect(ctx, pi)
+	if err == nil || !th.shouldPunch(ctx, pi.ID) {
+		return err
+	}
+
+	log.Info("Dial to ", pi.ID, " failed, trying hole punching: ", err)
+	if perr := th.punch(ctx, pi.ID); perr != nil {
+		return fmt.Errorf("dial failed: %s; hole punching failed: %s", err, perr)
+	}
+	return nil
+}
+
+// NewStream implements host.Host.
+func (th *traversalHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (inet.Stream, error) {
+	s, err := th.Host.NewStream(ctx, p, pids...)
+	if err == nil || !th.shouldPunch(ctx, p) {
+		return s, err
+	}
+
+	log.Info("Dial to ", p, " failed, trying hole punching: ", err)
+	if perr := th.punch(ctx, p); perr != nil {
+		return nil, fmt.Errorf("dial failed: %s; hole punching failed: %s", err, perr)
+	}
+	return th.Host.NewStream(ctx, p, pids...)
+}
+
+// shouldPunch reports whether a failed operation to p was caused by a dial
+// failure which hole punching could fix.
+func (th *traversalHost) shouldPunch(ctx context.Context, p peer.ID) bool {
+	if ctx.Err() != nil || p == th.ID() {
+		return false
+	}
+	// We are connected, so the failure was not about reaching the peer.
+	if th.Network().Connectedness(p) == inet.Connected {
+		return false
+	}
+	return !th.nt.isServiceNode(p)
+}
+
+func (th *traversalHost) punch(ctx context.Context, p peer.ID) error {
+	_, err := th.nt.Punch(ctx, p)
+	return err
+}
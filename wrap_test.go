@@ -0,0 +1,50 @@
+package ntraversal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestWrapHostConnect(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	cases := []struct {
+		name    string
+		opts    []Option
+		timeout time.Duration
+		want    string
+	}{
+		{"punch fails", []Option{BootstrapServer}, 5 * time.Second, "Could not find a peer"},
+		{"service node never answers", []Option{BootstrapServer, Authorize(func(peer.ID) bool {
+			<-release
+			return false
+		})}, 200 * time.Millisecond, "context deadline exceeded"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mn := mocknet.New(context.Background())
+			sn := newTestTraversalOn(t, mn, stubRouter{}, c.opts...)
+			client := newTestClient(t, mn, sn)
+			h := WrapHost(client.host, client)
+
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+
+			p := testPeer(t)
+			err := h.Connect(ctx, pstore.PeerInfo{ID: p})
+			if err == nil || !strings.Contains(err.Error(), "hole punching failed") || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("got %v, want a punch failure with %q", err, c.want)
+			}
+			if client.pending(p) != nil {
+				t.Fatal("punch is still pending")
+			}
+		})
+	}
+}